@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Channel is the part of *amqp.Channel that publishers, subscribers and
+// topologies use, so they can run against an in-memory broker in tests.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// ConfirmPublisher is a Channel that waits for the broker to confirm each
+// message, such as ConfirmChannel
+type ConfirmPublisher interface {
+	Channel
+	Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error
+}
+
+// Consumer runs fn for the deliveries of a queue until ctx is done, such as
+// Connection
+type Consumer interface {
+	Consume(ctx context.Context, opts ConsumeOptions, fn DeliveryFunc) error
+}
+
+// PublisherConn opens confirm channels and reports when the broker blocks
+// publishing, such as Connection
+type PublisherConn interface {
+	ConfirmChannel() (ConfirmPublisher, error)
+	WaitUnblocked(ctx context.Context) error
+}
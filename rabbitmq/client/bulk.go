@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// maxBulkLine is the longest line BulkPublish reads
+const maxBulkLine = 16 << 20
+
+// BulkMessage is one line of a bulk publish file. Every field is optional
+// except the body. The fields match the dlq-export format, so an export can
+// be published again.
+type BulkMessage struct {
+	Body          json.RawMessage        `json:"body,omitempty"`        // a JSON string is sent as its text, anything else as JSON
+	BodyBase64    string                 `json:"body_base64,omitempty"` // for binary bodies
+	RoutingKey    string                 `json:"routing_key,omitempty"`
+	Headers       map[string]interface{} `json:"headers,omitempty"`
+	MessageID     string                 `json:"message_id,omitempty"`
+	Type          string                 `json:"type,omitempty"`
+	Version       string                 `json:"version,omitempty"`
+	CorrelationID string                 `json:"correlation_id,omitempty"`
+	CausationID   string                 `json:"causation_id,omitempty"`
+	ContentType   string                 `json:"content_type,omitempty"`
+	Priority      uint8                  `json:"priority,omitempty"`
+	Expiration    string                 `json:"expiration,omitempty"` // per-message TTL in milliseconds
+}
+
+func (m *BulkMessage) body() ([]byte, error) {
+	if m.BodyBase64 != "" {
+		return base64.StdEncoding.DecodeString(m.BodyBase64)
+	}
+	if len(m.Body) == 0 {
+		return nil, errors.New("no body or body_base64")
+	}
+	var s string
+	if json.Unmarshal(m.Body, &s) == nil {
+		return []byte(s), nil
+	}
+	return m.Body, nil
+}
+
+type BulkPayload struct {
+	Conn         PublisherConn
+	Topic        string
+	ExchangeType string            // direct, topic, fanout, headers or x-consistent-hash
+	RoutingKey   string            // for lines without a routing key; defaults to the main queue name
+	Headers      map[string]string // defaults for every line, overridden by the line's headers
+	Input        io.Reader
+	Skip         int      // lines handled by a previous run
+	Rate         float64  // max messages per second, 0 = unlimited
+	Workers      int      // publishers, sharing a pool of as many confirm channels
+	Envelope     Envelope // defaults for every line; each line gets its own message ID
+	Schemas      *SchemaRegistry
+}
+
+// BulkReport counts the outcome of a bulk publish
+type BulkReport struct {
+	Sent      int
+	Confirmed int
+	Nacked    int
+	Returned  int
+	Resume    int // every line up to this one was handled; pass it as -skip to continue
+	Elapsed   time.Duration
+}
+
+func (r *BulkReport) String() string {
+	rate := 0.0
+	if r.Elapsed > 0 {
+		rate = float64(r.Confirmed) / r.Elapsed.Seconds()
+	}
+	return fmt.Sprintf("Sent %d, confirmed %d, nacked %d, returned %d in %s (%.0f msg/s)",
+		r.Sent, r.Confirmed, r.Nacked, r.Returned, r.Elapsed.Truncate(time.Millisecond), rate)
+}
+
+// bulkJob is a parsed line waiting for a publisher
+type bulkJob struct {
+	line       int
+	routingKey string
+	msg        amqp.Publishing
+}
+
+// bulkProgress tracks the report and the lines that finished. Lines finish
+// out of order with several workers, so Resume only advances past a line
+// once every line before it finished too.
+type bulkProgress struct {
+	mu     sync.Mutex
+	report BulkReport
+	done   map[int]bool
+}
+
+func (p *bulkProgress) finish(line int, count *int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if count != nil {
+		*count++
+	}
+	p.done[line] = true
+	for p.done[p.report.Resume+1] {
+		delete(p.done, p.report.Resume+1)
+		p.report.Resume++
+	}
+}
+
+// BulkPublish publishes every line of payload.Input as a message and waits
+// for each confirm. Nacked and returned messages are logged with their line
+// number and counted; any other error stops the run. The report is returned
+// in both cases, and Resume tells where a new run should start.
+func BulkPublish(ctx context.Context, payload *BulkPayload) (*BulkReport, error) {
+	if payload.ExchangeType == "" {
+		payload.ExchangeType = "direct"
+	}
+	workers := max(payload.Workers, 1)
+
+	pool, err := NewPublisherPool(payload.Conn, workers)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	// Declare the exchange before reading, so a mismatch fails straight away
+	spec := eventsExchange(payload.Topic, payload.ExchangeType)
+	if err := pool.WithChannel(ctx, func(ch ConfirmPublisher) error { return pool.declare(ch, spec) }); err != nil {
+		return nil, err
+	}
+
+	progress := &bulkProgress{report: BulkReport{Resume: payload.Skip}, done: map[int]bool{}}
+	start := time.Now()
+
+	// Reading stops on the first failure or on ctx; messages already handed
+	// to a publisher are still confirmed.
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errOnce sync.Once
+	var runErr error
+	fail := func(err error) {
+		errOnce.Do(func() { runErr = err })
+		cancel()
+	}
+
+	jobs := make(chan bulkJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				progress.mu.Lock()
+				progress.report.Sent++
+				progress.mu.Unlock()
+
+				err := pool.Publish(context.WithoutCancel(ctx), payload.ExchangeType, payload.Topic, PoolMessage{RoutingKey: job.routingKey, Publishing: job.msg})
+				switch {
+				case err == nil:
+					progress.finish(job.line, &progress.report.Confirmed)
+				case errors.Is(err, ErrUnroutable):
+					log.Printf("line %d: %v", job.line, err)
+					progress.finish(job.line, &progress.report.Returned)
+				case errors.Is(err, ErrPublishNacked):
+					log.Printf("line %d: %v", job.line, err)
+					progress.finish(job.line, &progress.report.Nacked)
+				default:
+					fail(fmt.Errorf("line %d: %w", job.line, err))
+					// Drain the queue so the reader does not block
+					for range jobs {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	readErr := payload.read(readCtx, progress, jobs)
+	close(jobs)
+	wg.Wait()
+	if readErr != nil && !errors.Is(readErr, context.Canceled) {
+		fail(readErr)
+	}
+	if runErr == nil && ctx.Err() != nil {
+		runErr = ctx.Err()
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	report := progress.report
+	report.Elapsed = time.Since(start)
+	return &report, runErr
+}
+
+// MaxBulkRate is the highest Rate, one message per nanosecond. Higher rates
+// would need a ticker interval below its resolution.
+const MaxBulkRate = 1e9
+
+// read parses the input after payload.Skip lines and sends each message to
+// jobs, at most payload.Rate per second
+func (p *BulkPayload) read(ctx context.Context, progress *bulkProgress, jobs chan<- bulkJob) error {
+	var tick <-chan time.Time
+	if p.Rate > 0 {
+		// Rates above MaxBulkRate still get a valid, if unreachable, interval
+		ticker := time.NewTicker(max(time.Duration(float64(time.Second)/p.Rate), time.Nanosecond))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	scanner := bufio.NewScanner(p.Input)
+	scanner.Buffer(make([]byte, 64*1024), maxBulkLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line <= p.Skip {
+			continue
+		}
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			progress.finish(line, nil)
+			continue
+		}
+		routingKey, msg, err := p.publishing(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case jobs <- bulkJob{line: line, routingKey: routingKey, msg: msg}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("line %d: %w", line+1, err)
+	}
+	return nil
+}
+
+// publishing builds the message of one line
+func (p *BulkPayload) publishing(text []byte) (string, amqp.Publishing, error) {
+	var m BulkMessage
+	dec := json.NewDecoder(bytes.NewReader(text))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return "", amqp.Publishing{}, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	body, err := m.body()
+	if err != nil {
+		return "", amqp.Publishing{}, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+
+	routingKey := ""
+	if p.ExchangeType != "fanout" && p.ExchangeType != "headers" {
+		routingKey = m.RoutingKey
+		if routingKey == "" {
+			routingKey = p.RoutingKey
+		}
+		if routingKey == "" && p.ExchangeType == ConsistentHashExchange {
+			return "", amqp.Publishing{}, fmt.Errorf("%w: no routing_key to partition by", ErrInvalidPayload)
+		}
+		if routingKey == "" {
+			routingKey = util.GetQueueName(p.Topic, "main", util.NormalQueue)
+		}
+		if p.ExchangeType == "topic" {
+			if err := util.ValidateRoutingKey(routingKey); err != nil {
+				return "", amqp.Publishing{}, err
+			}
+		}
+	}
+
+	env := p.Envelope
+	env.MessageID = m.MessageID
+	if env.MessageID == "" {
+		env.MessageID = newMessageID()
+	}
+	if m.Type != "" {
+		env.Type = m.Type
+	}
+	if m.Version != "" {
+		env.Version = m.Version
+	}
+	if m.CorrelationID != "" {
+		env.CorrelationID = m.CorrelationID
+	}
+	if env.CorrelationID == "" {
+		env.CorrelationID = env.MessageID
+	}
+	if m.CausationID != "" {
+		env.CausationID = m.CausationID
+	}
+
+	if p.Schemas != nil {
+		if err := p.Schemas.Validate(env.Type, env.Version, body); err != nil {
+			return "", amqp.Publishing{}, fmt.Errorf("invalid message: %w", err)
+		}
+	}
+
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	headers := toTable(m.Headers)
+	for k, v := range p.Headers {
+		if _, ok := headers[k]; !ok {
+			if headers == nil {
+				headers = amqp.Table{}
+			}
+			headers[k] = v
+		}
+	}
+	if err := headers.Validate(); err != nil {
+		return "", amqp.Publishing{}, fmt.Errorf("%w: headers: %v", ErrInvalidPayload, err)
+	}
+	msg := amqp.Publishing{
+		Headers:      headers,
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		Priority:     m.Priority,
+		Expiration:   m.Expiration,
+		Body:         body,
+	}
+	env.Apply(&msg)
+	return routingKey, msg, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ErrCircuitOpen wraps handler errors that happened while the circuit
+// breaker is open. Such messages are requeued as they are, so no retry or
+// DLQ move is spent on a dependency that is known to be down.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // consuming normally
+	BreakerOpen                         // consumers cancelled until the cool-down ends
+	BreakerHalfOpen                     // consuming again; one more failure re-opens
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Number of buckets the failure window is split into
+const breakerBuckets = 10
+
+type breakerBucket struct {
+	start  time.Time
+	total  int
+	failed int
+}
+
+// CircuitBreaker pauses consumers when too many handlers fail. Only
+// transient errors count as failures: permanent errors are a problem of the
+// message, not of a dependency.
+//
+// The breaker opens when at least FailureRate of the outcomes in the last
+// Window failed, once there were MinRequests of them. Consumers then cancel
+// their subscription and requeue prefetched messages. After Cooldown it
+// half-opens and consumers resume; Probes successes close it again, and a
+// single failure re-opens it.
+type CircuitBreaker struct {
+	Name        string // for logs and metrics, e.g. the topic
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	Cooldown    time.Duration
+	Probes      int
+
+	mu       sync.Mutex
+	state    BreakerState
+	buckets  [breakerBuckets]breakerBucket
+	probes   int           // successes since half-opening
+	opened   chan struct{} // closed when the breaker opens
+	halfOpen chan struct{} // closed when an open breaker half-opens
+}
+
+func NewCircuitBreaker(name string, failureRate float64, minRequests int, window, cooldown time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{
+		Name:        name,
+		FailureRate: failureRate,
+		MinRequests: max(minRequests, 1),
+		Window:      window,
+		Cooldown:    cooldown,
+		Probes:      5,
+		opened:      make(chan struct{}),
+		halfOpen:    make(chan struct{}),
+	}
+	close(b.halfOpen)
+	metrics.breakerState.Record(context.Background(), int64(BreakerClosed), b.labels())
+	return b
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Opened returns a channel that is closed when the breaker next opens. It is
+// nil for a nil breaker, so selecting on it never fires.
+func (b *CircuitBreaker) Opened() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.opened
+}
+
+// Wait blocks while the breaker is open
+func (b *CircuitBreaker) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	halfOpen := b.halfOpen
+	b.mu.Unlock()
+	select {
+	case <-halfOpen:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Record counts a handler outcome and reports whether the breaker is open
+// afterwards
+func (b *CircuitBreaker) Record(err error) bool {
+	if err != nil && IsPermanent(err) {
+		return b.State() == BreakerOpen
+	}
+	failed := err != nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		b.count(failed)
+		if total, failures := b.totals(); total >= b.MinRequests && float64(failures) >= b.FailureRate*float64(total) {
+			log.Printf("Circuit breaker %s: %d of %d messages failed in %s", b.Name, failures, total, b.Window)
+			b.open()
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			break
+		}
+		b.probes++
+		if b.probes >= b.Probes {
+			b.buckets = [breakerBuckets]breakerBucket{}
+			b.setState(BreakerClosed)
+		}
+	}
+	return b.state == BreakerOpen
+}
+
+// count adds an outcome to the bucket of the current time
+func (b *CircuitBreaker) count(failed bool) {
+	size := b.Window / breakerBuckets
+	now := time.Now()
+	start := now.Truncate(size)
+	bucket := &b.buckets[(start.UnixNano()/int64(size))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+}
+
+// totals sums the buckets within the window
+func (b *CircuitBreaker) totals() (total, failed int) {
+	since := time.Now().Add(-b.Window)
+	for _, bucket := range b.buckets {
+		if bucket.start.After(since) {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	return total, failed
+}
+
+// open opens the breaker and schedules the half-open transition
+func (b *CircuitBreaker) open() {
+	b.setState(BreakerOpen)
+	close(b.opened)
+	b.halfOpen = make(chan struct{})
+	time.AfterFunc(b.Cooldown, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.state != BreakerOpen {
+			return
+		}
+		b.probes = 0
+		b.opened = make(chan struct{})
+		b.setState(BreakerHalfOpen)
+		close(b.halfOpen)
+	})
+}
+
+func (b *CircuitBreaker) setState(s BreakerState) {
+	log.Printf("Circuit breaker %s: %s -> %s", b.Name, b.state, s)
+	b.state = s
+	ctx := context.Background()
+	metrics.breakerState.Record(ctx, int64(s), b.labels())
+	metrics.breakerTransitions.Add(ctx, 1, b.labels(attribute.String("state", s.String())))
+}
+
+func (b *CircuitBreaker) labels(extra ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributes(append([]attribute.KeyValue{attribute.String("service", b.Name)}, extra...)...)
+}
+
+// Handler records the outcome of next. Transient errors while the breaker
+// is open are wrapped with ErrCircuitOpen.
+func (b *CircuitBreaker) Handler(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		err := next.Handle(ctx, d)
+		if b.Record(err) && err != nil && !IsPermanent(err) {
+			return fmt.Errorf("%w: %w", ErrCircuitOpen, err)
+		}
+		return err
+	})
+}
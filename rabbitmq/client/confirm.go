@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrPublishNacked is returned when the broker nacks a published message,
+	// usually because a queue with x-overflow reject-publish is full
+	ErrPublishNacked = errors.New("publish nacked by broker")
+	// ErrUnroutable is returned when a mandatory message matched no queue
+	ErrUnroutable = errors.New("message unroutable")
+	// ErrChannelClosed is returned when the channel closes before the confirm arrives
+	ErrChannelClosed = errors.New("channel closed before publish was confirmed")
+)
+
+// ReturnedError describes a mandatory message returned by the broker
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("message returned by broker: %d %s (exchange %q, routing key %q)",
+		e.ReplyCode, e.ReplyText, e.Exchange, e.RoutingKey)
+}
+
+func (e *ReturnedError) Unwrap() error {
+	return ErrUnroutable
+}
+
+// NackedError describes a message the broker refused. AMQP nacks carry no
+// reason, but unless the broker failed, a queue the message was routed to
+// is full and set to x-overflow reject-publish or reject-publish-dlx.
+type NackedError struct {
+	Exchange   string
+	RoutingKey string
+}
+
+func (e *NackedError) Error() string {
+	return fmt.Sprintf("message nacked by broker (exchange %q, routing key %q): a queue it was routed to is full (x-overflow reject-publish) or the broker could not store it",
+		e.Exchange, e.RoutingKey)
+}
+
+func (e *NackedError) Unwrap() error {
+	return ErrPublishNacked
+}
+
+// ConfirmChannel is a channel in confirm mode that publishes with the
+// mandatory flag and waits for the broker's ack, nack or return.
+type ConfirmChannel struct {
+	*amqp.Channel
+
+	returns  chan amqp.Return
+	mu       sync.Mutex
+	returned map[string]amqp.Return // keyed by MessageId
+}
+
+// NewConfirmChannel puts ch into confirm mode and listens for returns
+func NewConfirmChannel(ch *amqp.Channel) (*ConfirmChannel, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("enable confirm mode: %w", err)
+	}
+	// Returns are delivered before the matching ack, so the buffer only has to
+	// hold one return per publisher waiting on this channel.
+	returns := ch.NotifyReturn(make(chan amqp.Return, 128))
+	return &ConfirmChannel{
+		Channel:  ch,
+		returns:  returns,
+		returned: map[string]amqp.Return{},
+	}, nil
+}
+
+// Publish sends msg and blocks until it is confirmed. It returns a
+// *ReturnedError when no queue is bound for the routing key and a
+// *NackedError, which is ErrPublishNacked, when the broker refuses the
+// message.
+//
+// A producer span is recorded for the publish and its trace context is
+// injected into the message headers.
+func (c *ConfirmChannel) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) (err error) {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+
+	ctx, span := startPublishSpan(ctx, exchange, routingKey, &msg)
+	defer func() {
+		if err != nil {
+			spanError(ctx, err)
+		}
+		span.End()
+	}()
+
+	dc, err := c.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+	metrics.published.Add(ctx, 1, publishLabels(exchange))
+
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if ret, ok := c.takeReturn(msg.MessageId); ok {
+		metrics.returned.Add(ctx, 1, publishLabels(exchange))
+		return &ReturnedError{
+			Exchange:   ret.Exchange,
+			RoutingKey: ret.RoutingKey,
+			ReplyCode:  ret.ReplyCode,
+			ReplyText:  ret.ReplyText,
+		}
+	}
+	if !acked {
+		if c.IsClosed() {
+			return ErrChannelClosed
+		}
+		metrics.publishNacked.Add(ctx, 1, publishLabels(exchange))
+		return &NackedError{Exchange: exchange, RoutingKey: routingKey}
+	}
+	metrics.confirmed.Add(ctx, 1, publishLabels(exchange))
+	return nil
+}
+
+// takeReturn drains pending returns and reports whether messageID was returned
+func (c *ConfirmChannel) takeReturn(messageID string) (amqp.Return, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for drained := false; !drained; {
+		select {
+		case ret, ok := <-c.returns:
+			if !ok {
+				drained = true
+				break
+			}
+			c.returned[ret.MessageId] = ret
+		default:
+			drained = true
+		}
+	}
+	ret, ok := c.returned[messageID]
+	delete(c.returned, messageID)
+	return ret, ok
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrConnectionClosed is returned once Close has been called on a Connection
+var ErrConnectionClosed = errors.New("connection closed")
+
+// ConnectionOptions configures a managed Connection
+type ConnectionOptions struct {
+	Nodes      []string    // AMQP URLs, tried in order on every (re)connect
+	Config     amqp.Config // heartbeat, TLS, vhost, client properties
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Connection wraps an AMQP connection and transparently reconnects across
+// the configured nodes when the broker closes it.
+type Connection struct {
+	opts ConnectionOptions
+
+	mu          sync.RWMutex
+	conn        *amqp.Connection
+	node        int           // index of the node conn is connected to
+	reconnected chan struct{} // closed and replaced after each reconnect
+	blocked     bool
+	unblocked   chan struct{} // closed while the connection is not blocked
+	closed      bool
+	done        chan struct{}
+}
+
+// Dial connects to the first reachable node and starts watching the
+// connection for closure.
+func Dial(opts ConnectionOptions) (*Connection, error) {
+	if len(opts.Nodes) == 0 {
+		return nil, errors.New("at least one node is required")
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+
+	unblocked := make(chan struct{})
+	close(unblocked)
+	c := &Connection{
+		opts:        opts,
+		node:        -1,
+		reconnected: make(chan struct{}),
+		unblocked:   unblocked,
+		done:        make(chan struct{}),
+	}
+
+	conn, err := c.dialAny()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.watch(conn)
+
+	return c, nil
+}
+
+// dialAny tries every node once, starting after the last connected node
+func (c *Connection) dialAny() (*amqp.Connection, error) {
+	var errs []error
+	for i := range c.opts.Nodes {
+		idx := (c.node + 1 + i) % len(c.opts.Nodes)
+		conn, err := amqp.DialConfig(c.opts.Nodes[idx], c.opts.Config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %d: %w", idx, err))
+			continue
+		}
+		c.node = idx
+		log.Printf("Connected to RabbitMQ node %d", idx)
+		return conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// watch waits for conn to close and reconnects until Close is called
+func (c *Connection) watch(conn *amqp.Connection) {
+	for {
+		closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+		blockCh := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+
+		c.watchBlocked(blockCh)
+
+		amqpErr := <-closeCh
+		if c.isClosed() {
+			return
+		}
+		log.Printf("Connection lost: %v; reconnecting", amqpErr)
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// watchBlocked tracks connection.blocked / connection.unblocked notifications.
+// The broker sends them when it hits a memory or disk alarm.
+func (c *Connection) watchBlocked(blockCh <-chan amqp.Blocking) {
+	go func() {
+		for b := range blockCh {
+			c.mu.Lock()
+			if b.Active && !c.blocked {
+				log.Printf("Connection blocked by broker: %s", b.Reason)
+				c.blocked = true
+				c.unblocked = make(chan struct{})
+			} else if !b.Active && c.blocked {
+				log.Printf("Connection unblocked by broker")
+				c.blocked = false
+				close(c.unblocked)
+			}
+			c.mu.Unlock()
+		}
+		// A closed connection is never unblocked by the broker
+		c.mu.Lock()
+		if c.blocked {
+			c.blocked = false
+			close(c.unblocked)
+		}
+		c.mu.Unlock()
+	}()
+}
+
+// reconnect dials with exponential backoff until it succeeds or Close is called
+func (c *Connection) reconnect() *amqp.Connection {
+	backoff := c.opts.MinBackoff
+	for {
+		conn, err := c.dialAny()
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				conn.Close()
+				return nil
+			}
+			c.conn = conn
+			close(c.reconnected)
+			c.reconnected = make(chan struct{})
+			c.mu.Unlock()
+			return conn
+		}
+
+		log.Printf("Reconnect failed: %v; retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return nil
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+func (c *Connection) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// Channel opens a channel on the current connection
+func (c *Connection) Channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	conn, closed := c.conn, c.closed
+	c.mu.RUnlock()
+	if closed {
+		return nil, ErrConnectionClosed
+	}
+	return conn.Channel()
+}
+
+// ConfirmChannel opens a channel in confirm mode on the current connection
+func (c *Connection) ConfirmChannel() (ConfirmPublisher, error) {
+	ch, err := c.Channel()
+	if err != nil {
+		return nil, err
+	}
+	cc, err := NewConfirmChannel(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Blocked reports whether the broker has currently blocked publishing
+func (c *Connection) Blocked() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.blocked
+}
+
+// WaitUnblocked returns once the connection is not blocked by the broker
+func (c *Connection) WaitUnblocked(ctx context.Context) error {
+	c.mu.RLock()
+	unblocked := c.unblocked
+	c.mu.RUnlock()
+	select {
+	case <-unblocked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrConnectionClosed
+	}
+}
+
+// waitReconnect blocks until the next reconnect, ctx is done, or Close is called.
+// It also returns after timeout so callers can retry channel-level failures.
+func (c *Connection) waitReconnect(ctx context.Context, reconnected <-chan struct{}, timeout time.Duration) error {
+	select {
+	case <-reconnected:
+		return nil
+	case <-time.After(timeout):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return ErrConnectionClosed
+	}
+}
+
+// Close stops reconnecting and closes the underlying connection
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Close()
+}
+
+// ConsumeOptions describes a consumer that survives reconnects
+type ConsumeOptions struct {
+	Tag       string // generated when empty, so the consumer can be cancelled
+	Prefetch  int
+	Exclusive bool
+	Args      amqp.Table
+	// ShutdownTimeout bounds how long in-flight handlers may run after ctx is
+	// done. Their context is cancelled when it expires.
+	ShutdownTimeout time.Duration
+	// Setup declares the consumer's exchanges, queues and bindings and returns
+	// the queue to consume. It runs on every new channel, so the topology is
+	// re-declared after a broker restart or failover.
+	Setup func(ch Channel) (queue string, err error)
+	// Breaker, when set, pauses the consumer while it is open
+	Breaker *CircuitBreaker
+	// SingleActive logs when the consumer of an x-single-active-consumer
+	// queue receives its first message. AMQP does not tell a consumer that it
+	// became the active one, so an active consumer of an empty queue logs
+	// nothing until a message arrives; the management API shows the active
+	// consumer as the queue's single_active_consumer_tag.
+	SingleActive bool
+}
+
+// DeliveryFunc handles one delivery. ch is the consumer's channel, in
+// confirm mode so messages moved elsewhere are only acked once the broker
+// confirmed them. ctx is not cancelled by shutdown until the consumer's
+// ShutdownTimeout has passed.
+type DeliveryFunc func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery)
+
+// Consume runs fn for every delivery until ctx is done or the connection is
+// closed. When the channel or connection is lost the Qos, topology and
+// consumer are set up again on a new channel. Errors from the first setup are
+// returned so misconfiguration is not retried forever.
+//
+// When ctx is done the consumer is cancelled, prefetched deliveries that were
+// not started are nacked back to the queue, and the in-flight delivery is
+// given up to ShutdownTimeout to finish before the channel is closed.
+func (c *Connection) Consume(ctx context.Context, opts ConsumeOptions, fn DeliveryFunc) error {
+	if opts.Tag == "" {
+		opts.Tag = "ctag-" + newMessageID()[:12]
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 30 * time.Second
+	}
+
+	started := false
+	backoff := c.opts.MinBackoff
+	for {
+		c.mu.RLock()
+		reconnected := c.reconnected
+		c.mu.RUnlock()
+
+		consumed, err := c.consumeOnce(ctx, opts, fn)
+		if ctx.Err() != nil || c.isClosed() {
+			return nil
+		}
+		if consumed {
+			// Setup succeeded at least once, so later failures are retried
+			started = true
+			backoff = c.opts.MinBackoff
+		}
+		if err != nil && !started {
+			return err
+		}
+		if err != nil {
+			log.Printf("Consumer %q failed: %v; restarting", opts.Tag, err)
+		} else {
+			log.Printf("Consumer %q stopped; restarting", opts.Tag)
+		}
+
+		if err := c.waitReconnect(ctx, reconnected, backoff); err != nil {
+			return nil
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+// consumeOnce runs a single channel session for a consumer and reports
+// whether the consumer was registered before the session ended.
+func (c *Connection) consumeOnce(ctx context.Context, opts ConsumeOptions, fn DeliveryFunc) (bool, error) {
+	ch, err := c.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+
+	if opts.Prefetch > 0 {
+		if err := ch.Qos(opts.Prefetch, 0, false); err != nil {
+			return false, err
+		}
+	}
+
+	queue, err := opts.Setup(ch)
+	if err != nil {
+		return false, err
+	}
+	confirmCh, err := NewConfirmChannel(ch)
+	if err != nil {
+		return false, err
+	}
+
+	if err := opts.Breaker.Wait(ctx); err != nil {
+		return false, nil
+	}
+	msgs, err := ch.Consume(
+		queue,          // queue
+		opts.Tag,       // consumer tag
+		false,          // auto-ack = false → manual ack
+		opts.Exclusive, // exclusive
+		false,          // no-local
+		false,          // no-wait
+		opts.Args,      // args
+	)
+	if err != nil {
+		return false, err
+	}
+	received := false
+	if opts.SingleActive {
+		log.Printf("Consumer %s registered on %s, single active consumer or standby", opts.Tag, queue)
+	}
+
+	// Handlers keep running through shutdown until the drain timeout
+	handlerCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+
+	work := make(chan amqp.Delivery)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for d := range work {
+			fn(handlerCtx, confirmCh, d)
+		}
+	}()
+
+	for {
+		opened := opts.Breaker.Opened()
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				// Channel or connection lost; unacked deliveries are requeued by the broker
+				close(work)
+				<-done
+				return true, nil
+			}
+			if opts.SingleActive && !received {
+				received = true
+				log.Printf("Consumer %s received its first delivery from %s, so it is the single active consumer", opts.Tag, queue)
+			}
+			select {
+			case work <- d:
+				continue
+			case <-opened:
+				_ = d.Nack(false, true) // requeue = true
+			case <-ctx.Done():
+				_ = d.Nack(false, true) // requeue = true
+				drainConsumer(ch, opts, msgs, work, done, cancelHandlers)
+				return true, nil
+			}
+		case <-opened:
+		case <-ctx.Done():
+			drainConsumer(ch, opts, msgs, work, done, cancelHandlers)
+			return true, nil
+		}
+
+		// The circuit breaker opened
+		msgs, err = pauseConsumer(ctx, ch, opts, queue, msgs)
+		if ctx.Err() != nil {
+			drainConsumer(ch, opts, nil, work, done, cancelHandlers)
+			return true, nil
+		}
+		if err != nil {
+			close(work)
+			<-done
+			return true, err
+		}
+	}
+}
+
+// pauseConsumer cancels the consumer while the circuit breaker is open. It
+// requeues the deliveries that were prefetched but not started, waits for
+// the breaker to half-open and consumes again on the same channel. The
+// in-flight delivery keeps running.
+func pauseConsumer(ctx context.Context, ch *amqp.Channel, opts ConsumeOptions, queue string, msgs <-chan amqp.Delivery) (<-chan amqp.Delivery, error) {
+	log.Printf("Consumer %q paused by circuit breaker %s", opts.Tag, opts.Breaker.Name)
+	if err := ch.Cancel(opts.Tag, false); err != nil {
+		return nil, err
+	}
+	requeued := 0
+	for d := range msgs {
+		_ = d.Nack(false, true) // requeue = true
+		requeued++
+	}
+	if requeued > 0 {
+		log.Printf("Consumer %q requeued %d prefetched messages", opts.Tag, requeued)
+	}
+
+	if err := opts.Breaker.Wait(ctx); err != nil {
+		return nil, err
+	}
+	log.Printf("Consumer %q resuming", opts.Tag)
+	return ch.Consume(
+		queue,          // queue
+		opts.Tag,       // consumer tag
+		false,          // auto-ack = false → manual ack
+		opts.Exclusive, // exclusive
+		false,          // no-local
+		false,          // no-wait
+		opts.Args,      // args
+	)
+}
+
+// drainConsumer stops a consumer on shutdown. It cancels the consumer so the broker
+// stops sending, requeues deliveries that were prefetched but not started and
+// waits up to ShutdownTimeout for the in-flight handler.
+func drainConsumer(ch *amqp.Channel, opts ConsumeOptions, msgs <-chan amqp.Delivery, work chan amqp.Delivery, done <-chan struct{}, cancelHandlers context.CancelFunc) {
+	log.Printf("Consumer %q shutting down, waiting up to %s for in-flight messages", opts.Tag, opts.ShutdownTimeout)
+	// msgs is nil when the consumer was already cancelled
+	if msgs != nil {
+		if err := ch.Cancel(opts.Tag, false); err != nil {
+			log.Printf("Consumer %q cancel failed: %v", opts.Tag, err)
+		}
+	}
+	close(work)
+
+	requeued := 0
+	timeout := time.After(opts.ShutdownTimeout)
+	for msgs != nil || done != nil {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				continue
+			}
+			_ = d.Nack(false, true) // requeue = true
+			requeued++
+		case <-done:
+			done = nil
+		case <-timeout:
+			// Closing the channel requeues whatever is still unacked
+			log.Printf("Consumer %q shutdown timed out, cancelling in-flight handlers", opts.Tag)
+			cancelHandlers()
+			return
+		}
+	}
+	log.Printf("Consumer %q stopped cleanly, requeued %d prefetched messages", opts.Tag, requeued)
+}
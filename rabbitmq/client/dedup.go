@@ -0,0 +1,267 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DedupStore remembers the keys of processed messages for a TTL
+type DedupStore interface {
+	// Seen reports whether key was marked and has not expired
+	Seen(ctx context.Context, key string) (bool, error)
+	// Mark records key as processed
+	Mark(ctx context.Context, key string) error
+	Close() error
+}
+
+// DedupKeyFunc extracts the deduplication key of a delivery. Deliveries
+// without a key are always processed.
+type DedupKeyFunc func(d amqp.Delivery) (string, bool)
+
+// DedupByMessageID keys deliveries by their message-id property
+func DedupByMessageID(d amqp.Delivery) (string, bool) {
+	return d.MessageId, d.MessageId != ""
+}
+
+// DedupByHeader keys deliveries by the value of a header
+func DedupByHeader(name string) DedupKeyFunc {
+	return func(d amqp.Delivery) (string, bool) {
+		v, ok := d.Headers[name]
+		if !ok || v == nil {
+			return "", false
+		}
+		return fmt.Sprint(v), true
+	}
+}
+
+// DedupByBodyHash keys deliveries by the SHA-256 of their body, for
+// publishers that do not set a stable message ID
+func DedupByBodyHash(d amqp.Delivery) (string, bool) {
+	sum := sha256.Sum256(d.Body)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// ParseDedupKey accepts message-id, header:<name> or body-hash
+func ParseDedupKey(s string) (DedupKeyFunc, error) {
+	switch {
+	case s == "" || s == "message-id":
+		return DedupByMessageID, nil
+	case s == "body-hash":
+		return DedupByBodyHash, nil
+	case strings.HasPrefix(s, "header:") && len(s) > len("header:"):
+		return DedupByHeader(strings.TrimPrefix(s, "header:")), nil
+	}
+	return nil, fmt.Errorf("invalid dedup key %q, must be message-id, header:<name> or body-hash", s)
+}
+
+// Deduplicator skips messages that were already handled successfully
+type Deduplicator struct {
+	Store DedupStore
+	Key   DedupKeyFunc
+}
+
+// Handler wraps next so duplicates are acked without running it. Keys are
+// scoped by topic, so services can share a store. A message is marked only
+// after next succeeds: failed messages, their retries and DLQ replays keep
+// the same message ID and must still be processed.
+//
+// Two workers that receive copies of a message at the same time can both
+// run it; the store catches redeliveries, not concurrent duplicates.
+func (x *Deduplicator) Handler(topic string, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		key, ok := x.Key(d)
+		if !ok {
+			return next.Handle(ctx, d)
+		}
+		key = topic + "/" + key
+
+		seen, err := x.Store.Seen(ctx, key)
+		if err != nil {
+			return fmt.Errorf("dedup lookup: %w", err)
+		}
+		if seen {
+			log.Printf("Skipping duplicate message %s", key)
+			return nil
+		}
+
+		if err := next.Handle(ctx, d); err != nil {
+			return err
+		}
+		if err := x.Store.Mark(ctx, key); err != nil {
+			// The message was processed, so it is still acked
+			log.Printf("Failed to mark message %s as processed: %v", key, err)
+		}
+		return nil
+	})
+}
+
+// MemoryDedupStore keeps up to size keys in memory, evicting the least
+// recently used. Its contents are lost on restart.
+type MemoryDedupStore struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(el.Value.(*dedupEntry).expires) {
+		s.order.Remove(el)
+		delete(s.items, key)
+		return false, nil
+	}
+	s.order.MoveToFront(el)
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(s.ttl)
+	if el, ok := s.items[key]; ok {
+		el.Value.(*dedupEntry).expires = expires
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.items[key] = s.order.PushFront(&dedupEntry{key: key, expires: expires})
+	for s.size > 0 && s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*dedupEntry).key)
+	}
+	return nil
+}
+
+func (s *MemoryDedupStore) Close() error {
+	return nil
+}
+
+// dedupBucket maps keys to their expiry time as big-endian Unix nanoseconds
+var dedupBucket = []byte("processed")
+
+// BoltDedupStore persists keys in a bbolt file, so duplicates are also caught
+// across restarts. Expired keys are removed in the background.
+type BoltDedupStore struct {
+	db   *bolt.DB
+	ttl  time.Duration
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenBoltDedupStore opens or creates the store file. Only one process can
+// hold the file open at a time.
+func OpenBoltDedupStore(path string, ttl time.Duration) (*BoltDedupStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open dedup store %s: %w", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(dedupBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open dedup store %s: %w", path, err)
+	}
+
+	s := &BoltDedupStore{db: db, ttl: ttl, done: make(chan struct{})}
+	s.wg.Add(1)
+	go s.sweepLoop(min(ttl, time.Minute))
+	return s, nil
+}
+
+func (s *BoltDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	var seen bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(dedupBucket).Get([]byte(key))
+		seen = len(v) == 8 && time.Now().UnixNano() < int64(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return seen, err
+}
+
+func (s *BoltDedupStore) Mark(ctx context.Context, key string) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(time.Now().Add(s.ttl).UnixNano()))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dedupBucket).Put([]byte(key), v)
+	})
+}
+
+func (s *BoltDedupStore) sweepLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.sweep(); err != nil {
+				log.Printf("Dedup store sweep failed: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sweep deletes expired keys
+func (s *BoltDedupStore) sweep() error {
+	now := time.Now().UnixNano()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// Deleting while iterating with a cursor skips keys, so collect first
+		b := tx.Bucket(dedupBucket)
+		var expired [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || int64(binary.BigEndian.Uint64(v)) <= now {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltDedupStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.db.Close()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// DelayedMessageExchange is the exchange type of the
+// rabbitmq_delayed_message_exchange plugin. It holds each message for its
+// x-delay header, in milliseconds, then routes it like its x-delayed-type.
+const DelayedMessageExchange = "x-delayed-message"
+
+// DelayMode is how delayed messages are held until they are due
+type DelayMode string
+
+const (
+	DelayPlugin DelayMode = "plugin" // x-delayed-message exchange, exact delays
+	DelayTTL    DelayMode = "ttl"    // TTL bucket queues, no plugin needed
+)
+
+// ParseDelayMode accepts plugin or ttl; empty means plugin
+func ParseDelayMode(s string) (DelayMode, error) {
+	switch mode := DelayMode(s); mode {
+	case "":
+		return DelayPlugin, nil
+	case DelayPlugin, DelayTTL:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid delay mode %q, must be plugin or ttl", s)
+}
+
+// MaxDelay is the longest delay the plugin accepts, 2^32-1 milliseconds
+// (about 49 days)
+const MaxDelay = (1<<32 - 1) * time.Millisecond
+
+// Header selecting the TTL bucket queue of a delayed message. Headers
+// exchanges do not match x- headers, so it has no x- prefix.
+const HeaderDelayBucket = "delay-bucket"
+
+// ParseDelay returns the delay of a message published at now, from either
+// -delay or -deliver-at, an RFC 3339 timestamp. Zero means no delay.
+func ParseDelay(delay time.Duration, deliverAt string, now time.Time) (time.Duration, error) {
+	if deliverAt != "" {
+		if delay != 0 {
+			return 0, errors.New("use either a delay or a delivery time, not both")
+		}
+		at, err := time.Parse(time.RFC3339, deliverAt)
+		if err != nil {
+			return 0, fmt.Errorf("invalid delivery time %q, must be RFC 3339: %w", deliverAt, err)
+		}
+		if !at.After(now) {
+			return 0, fmt.Errorf("delivery time %s is in the past", deliverAt)
+		}
+		delay = at.Sub(now)
+	}
+	if delay < 0 || delay > MaxDelay {
+		return 0, fmt.Errorf("delay %s must be positive and at most %s", delay, MaxDelay)
+	}
+	return delay, nil
+}
+
+// DelayBucket rounds a delay up to its TTL bucket: whole seconds under a
+// minute, whole minutes above. Every bucket is a queue, so rounding keeps
+// their number small at the cost of delivering up to a minute late.
+func DelayBucket(d time.Duration) time.Duration {
+	unit := time.Second
+	if d > time.Minute {
+		unit = time.Minute
+	}
+	return (d + unit - 1) / unit * unit
+}
+
+// delayQueueName names the TTL bucket queue of a delay, e.g. q.orders.main.delay.5m
+func delayQueueName(service string, bucket time.Duration) string {
+	return util.GetQueueName(service, "main", util.DelayQueue, util.FormatDelay(bucket))
+}
+
+// Delay Exchange (headers) -> Bucket Queue (TTL) -> Events Exchange
+//
+// The delay exchange is ttl-delay.<service>.x, so it does not clash with the
+// plugin's delay.<service>.x when the delay mode changes. The bucket has no
+// dead-letter routing key, so expired messages are routed by events with the
+// key they were published with, like any other message. Unused buckets are
+// deleted by x-expires once their last message is due.
+func DelayTopology(events ExchangeRef, bucket time.Duration) *Topology {
+	service := events.Service
+	delayExchange := ExchangeRef{Service: service, Kind: util.TTLDelay}
+	queue := QueueRef{Name: delayQueueName(service, bucket)}
+
+	return &Topology{
+		Exchanges: []ExchangeSpec{
+			{ExchangeRef: delayExchange, Type: "headers", Durable: true},
+		},
+		Queues: []QueueSpec{{
+			QueueRef: queue,
+			Durable:  true,
+			QueueLimits: QueueLimits{
+				MessageTTL: bucket.Milliseconds(),
+				Expires:    (bucket + time.Minute).Milliseconds(),
+			},
+			DeadLetter: &DeadLetterSpec{Exchange: events},
+		}},
+		Bindings: []BindingSpec{{
+			Exchange: delayExchange,
+			Queue:    queue,
+			Headers:  map[string]interface{}{HeaderDelayBucket: util.FormatDelay(bucket)},
+		}},
+	}
+}
+
+// Method 6: delayed delivery. The message is held by delay.<topic>.x, or
+// ttl-delay.<topic>.x in the ttl mode, and then routed by the exchange of
+// exchangeType, so subscribers receive it like any other message.
+func PublisherDelayed(ctx context.Context, payload *PublisherPayload, exchangeType string) error {
+	events := eventsExchange(payload.Topic, exchangeType)
+	if err := events.Declare(payload.Channel); err != nil {
+		return err
+	}
+	routingKey, err := exchangeRoutingKey(exchangeType, payload.Topic, payload.RoutingKey)
+	if err != nil {
+		return err
+	}
+
+	msg, err := payload.publishing()
+	if err != nil {
+		return err
+	}
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+
+	delayExchange := util.GetExchangeName(payload.Topic, util.Delay)
+	switch payload.DelayMode {
+	case DelayTTL:
+		delayExchange = util.GetExchangeName(payload.Topic, util.TTLDelay)
+		bucket := DelayBucket(payload.Delay)
+		if err := DelayTopology(events.ExchangeRef, bucket).Apply(payload.Channel); err != nil {
+			return err
+		}
+		msg.Headers[HeaderDelayBucket] = util.FormatDelay(bucket)
+		// The bucket's x-death entry is not a failed attempt
+		msg.Headers[HeaderRetryCount] = int64(0)
+	default:
+		spec := ExchangeSpec{
+			ExchangeRef: ExchangeRef{Service: payload.Topic, Kind: util.Delay},
+			Type:        DelayedMessageExchange,
+			Durable:     true,
+			Arguments:   map[string]interface{}{"x-delayed-type": "fanout"},
+		}
+		if err := spec.Declare(payload.Channel); err != nil {
+			return fmt.Errorf("%w (enable the rabbitmq_delayed_message_exchange plugin or use the ttl delay mode)", err)
+		}
+		// Every due message is passed on to the events exchange with its routing key
+		if err := payload.Channel.ExchangeBind(
+			events.ExchangeName(), // destination
+			"",                    // routing key (ignored by fanout)
+			delayExchange,         // source
+			false,                 // no-wait
+			nil,                   // arguments
+		); err != nil {
+			return fmt.Errorf("bind %s to %s: %w", events.ExchangeName(), delayExchange, err)
+		}
+		msg.Headers["x-delay"] = payload.Delay.Milliseconds()
+	}
+
+	// Publish the message and wait for the broker to confirm it
+	err = payload.Channel.Publish(
+		ctx,
+		delayExchange, // exchange
+		routingKey,    // routing key (used by the events exchange when the message is due)
+		msg,
+	)
+	// The plugin only routes messages once they are due, so it returns
+	// every mandatory message as unroutable
+	if payload.DelayMode != DelayTTL && errors.Is(err, ErrUnroutable) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("publish to %s: %w", delayExchange, err)
+	}
+
+	fmt.Printf("Published delayed message to topic: %s | delivery in: %s | message: %s\n", payload.Topic, payload.Delay, payload.Message)
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// Headers cleared when a message is replayed so it starts a fresh retry cycle
+var retryHeaders = []string{"x-death", "x-first-death-exchange", "x-first-death-queue", "x-first-death-reason",
+	"x-last-death-exchange", "x-last-death-queue", "x-last-death-reason", HeaderDLQReason, HeaderDeadLetteredAt, HeaderRetryCount}
+
+// Header set when a message is replayed from the DLQ
+const HeaderReplayedAt = "x-replayed-at"
+
+type DLQPayload struct {
+	Conn       *Connection
+	Management *ManagementClient
+	Topic      string
+	Limit      int       // max messages to read, 0 = every message in the queue
+	Filter     DLQFilter // replay only
+	All        bool      // replay every message when no filter is set
+	Force      bool      // required by purge, and to browse a quorum DLQ
+	Output     io.Writer // peek/export destination
+}
+
+// DLQFilter selects messages to replay. Every set condition must match.
+type DLQFilter struct {
+	Headers map[string]string // header name -> expected value (compared as text)
+	MinAge  time.Duration     // dead-lettered at least this long ago
+	MaxAge  time.Duration     // dead-lettered at most this long ago
+}
+
+func (f DLQFilter) empty() bool {
+	return len(f.Headers) == 0 && f.MinAge == 0 && f.MaxAge == 0
+}
+
+// Match reports whether the message satisfies the filter
+func (f DLQFilter) Match(m *DLQMessage, now time.Time) bool {
+	for k, want := range f.Headers {
+		got, ok := m.Headers[k]
+		if !ok || fmt.Sprint(got) != want {
+			return false
+		}
+	}
+	if f.MinAge > 0 || f.MaxAge > 0 {
+		if m.DeadLetteredAt == nil {
+			return false
+		}
+		age := now.Sub(*m.DeadLetteredAt)
+		if f.MinAge > 0 && age < f.MinAge {
+			return false
+		}
+		if f.MaxAge > 0 && age > f.MaxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// DeathRecord is one entry of the x-death header
+type DeathRecord struct {
+	Queue       string    `json:"queue"`
+	Reason      string    `json:"reason"`
+	Exchange    string    `json:"exchange"`
+	Count       int       `json:"count"`
+	Time        time.Time `json:"time,omitempty"`
+	RoutingKeys []string  `json:"routing_keys,omitempty"`
+}
+
+// DLQMessage is the decoded view of a dead-lettered message, also used as
+// the JSONL export format.
+type DLQMessage struct {
+	MessageID      string                 `json:"message_id,omitempty"`
+	Exchange       string                 `json:"exchange"`
+	RoutingKey     string                 `json:"routing_key"`
+	ContentType    string                 `json:"content_type,omitempty"`
+	Timestamp      *time.Time             `json:"timestamp,omitempty"`
+	DeadLetteredAt *time.Time             `json:"dead_lettered_at,omitempty"`
+	Reason         string                 `json:"reason,omitempty"`
+	Retries        int                    `json:"retries"`
+	Deaths         []DeathRecord          `json:"x_death,omitempty"`
+	Headers        map[string]interface{} `json:"headers,omitempty"`
+	Body           json.RawMessage        `json:"body,omitempty"`
+	BodyBase64     string                 `json:"body_base64,omitempty"`
+}
+
+// NewDLQMessage decodes a delivery read from a DLQ
+func NewDLQMessage(d amqp.Delivery) *DLQMessage {
+	m := &DLQMessage{
+		MessageID:   d.MessageId,
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+		ContentType: d.ContentType,
+		Retries:     getRetryCount(d),
+		Deaths:      decodeXDeath(d.Headers),
+		Headers:     d.Headers,
+	}
+	if !d.Timestamp.IsZero() {
+		ts := d.Timestamp
+		m.Timestamp = &ts
+	}
+	if reason, ok := d.Headers[HeaderDLQReason].(string); ok {
+		m.Reason = reason
+	}
+
+	// ProcessWithRetry stamps the time it moved the message, broker
+	// dead-lettering records it in x-death.
+	if at, ok := d.Headers[HeaderDeadLetteredAt].(time.Time); ok {
+		m.DeadLetteredAt = &at
+	} else if len(m.Deaths) > 0 && !m.Deaths[0].Time.IsZero() {
+		at := m.Deaths[0].Time
+		m.DeadLetteredAt = &at
+	} else {
+		m.DeadLetteredAt = m.Timestamp
+	}
+
+	switch {
+	case json.Valid(d.Body):
+		m.Body = json.RawMessage(d.Body)
+	case utf8.Valid(d.Body):
+		m.Body, _ = json.Marshal(string(d.Body))
+	default:
+		m.BodyBase64 = base64.StdEncoding.EncodeToString(d.Body)
+	}
+	return m
+}
+
+// decodeXDeath reads the x-death header, most recent entry first
+func decodeXDeath(headers amqp.Table) []DeathRecord {
+	var entries []interface{}
+	switch v := headers["x-death"].(type) {
+	case []interface{}:
+		entries = v
+	case amqp.Table:
+		entries = []interface{}{v}
+	default:
+		return nil
+	}
+
+	var records []DeathRecord
+	for _, entry := range entries {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		var r DeathRecord
+		r.Queue, _ = table["queue"].(string)
+		r.Reason, _ = table["reason"].(string)
+		r.Exchange, _ = table["exchange"].(string)
+		r.Time, _ = table["time"].(time.Time)
+		r.Count = getRetryCount(amqp.Delivery{Headers: amqp.Table{"x-death": table}})
+		if keys, ok := table["routing-keys"].([]interface{}); ok {
+			for _, k := range keys {
+				if s, ok := k.(string); ok {
+					r.RoutingKeys = append(r.RoutingKeys, s)
+				}
+			}
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// String renders the message for peek
+func (m *DLQMessage) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "message_id=%s routing_key=%s retries=%d", m.MessageID, m.RoutingKey, m.Retries)
+	if m.DeadLetteredAt != nil {
+		fmt.Fprintf(&b, " dead_lettered=%s (%s ago)", m.DeadLetteredAt.Format(time.RFC3339),
+			time.Since(*m.DeadLetteredAt).Truncate(time.Second))
+	}
+	if m.Reason != "" {
+		fmt.Fprintf(&b, "\n  reason: %s", m.Reason)
+	}
+	for _, d := range m.Deaths {
+		fmt.Fprintf(&b, "\n  x-death: queue=%s reason=%s count=%d exchange=%s time=%s",
+			d.Queue, d.Reason, d.Count, d.Exchange, d.Time.Format(time.RFC3339))
+	}
+	if m.BodyBase64 != "" {
+		fmt.Fprintf(&b, "\n  body (base64): %s", m.BodyBase64)
+	} else {
+		fmt.Fprintf(&b, "\n  body: %s", m.Body)
+	}
+	return b.String()
+}
+
+// DLQList prints the dead-letter queues of the vhost, or of one topic
+func DLQList(payload *DLQPayload) error {
+	queues, err := payload.Management.Queues(context.Background())
+	if err != nil {
+		return err
+	}
+	found := 0
+	for _, q := range queues {
+		if !strings.HasSuffix(q.Name, ".dlq") {
+			continue
+		}
+		if payload.Topic != "" && !strings.HasPrefix(q.Name, "q."+payload.Topic+".") {
+			continue
+		}
+		fmt.Fprintf(payload.Output, "%-40s %d messages\n", q.Name, q.Messages)
+		found++
+	}
+	if found == 0 {
+		fmt.Fprintln(payload.Output, "No dead-letter queues found")
+	}
+	return nil
+}
+
+// browseDLQ gets up to limit messages without acking them and calls fn for
+// each one. fn reports whether it acked the message; everything else is
+// requeued in order when browseDLQ returns.
+func browseDLQ(payload *DLQPayload, fn func(d amqp.Delivery) (acked bool, err error)) error {
+	dlqName := util.GetQueueName(payload.Topic, "main", util.DLQ)
+	if err := checkRequeueSafe(payload, dlqName); err != nil {
+		return err
+	}
+
+	ch, err := payload.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	// Only read what is in the queue now, so requeued or newly
+	// dead-lettered messages are not read twice.
+	q, err := ch.QueueDeclarePassive(dlqName, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", dlqName, err)
+	}
+	limit := q.Messages
+	if payload.Limit > 0 && payload.Limit < limit {
+		limit = payload.Limit
+	}
+
+	var lastUnacked uint64
+	var fnErr error
+	for i := 0; i < limit; i++ {
+		d, ok, err := ch.Get(dlqName, false)
+		if err != nil {
+			fnErr = err
+			break
+		}
+		if !ok {
+			break
+		}
+		acked, err := fn(d)
+		if !acked {
+			lastUnacked = d.DeliveryTag
+		}
+		if err != nil {
+			fnErr = err
+			break
+		}
+	}
+
+	if lastUnacked > 0 {
+		// Requeue every message that was not acked
+		if err := ch.Nack(lastUnacked, true, true); err != nil {
+			return errors.Join(fnErr, fmt.Errorf("requeue %s: %w", dlqName, err))
+		}
+	}
+	return fnErr
+}
+
+// checkRequeueSafe refuses to browse a quorum DLQ unless forced. A quorum
+// queue counts every requeue as a delivery and drops a message without a
+// dead-letter exchange once it reaches the delivery limit, 20 by default
+// since RabbitMQ 4.0, so each peek brings its messages closer to being lost.
+// Replaying with -all requeues nothing and is always allowed.
+func checkRequeueSafe(payload *DLQPayload, dlqName string) error {
+	if payload.Force || payload.All || payload.Management == nil {
+		return nil
+	}
+	queues, err := payload.Management.Queues(context.Background())
+	if err != nil {
+		return fmt.Errorf("check the queue type of %s (use -force to skip): %w", dlqName, err)
+	}
+	for _, q := range queues {
+		if q.Name == dlqName && q.Type == string(util.QuorumQueue) {
+			return fmt.Errorf("%s is a quorum queue: browsing requeues its messages, which counts towards their delivery limit and drops them once it is reached; use -force to browse anyway", dlqName)
+		}
+	}
+	return nil
+}
+
+// DLQPeek prints messages without consuming them
+func DLQPeek(payload *DLQPayload) error {
+	n := 0
+	err := browseDLQ(payload, func(d amqp.Delivery) (bool, error) {
+		n++
+		_, err := fmt.Fprintf(payload.Output, "#%d %s\n\n", n, NewDLQMessage(d))
+		return false, err
+	})
+	if err == nil && n == 0 {
+		fmt.Fprintln(payload.Output, "DLQ is empty")
+	}
+	return err
+}
+
+// DLQExport writes messages as JSON lines without consuming them
+func DLQExport(payload *DLQPayload) error {
+	enc := json.NewEncoder(payload.Output)
+	n := 0
+	err := browseDLQ(payload, func(d amqp.Delivery) (bool, error) {
+		n++
+		return false, enc.Encode(NewDLQMessage(d))
+	})
+	if err == nil {
+		// stdout may be the export itself
+		log.Printf("Exported %d messages", n)
+	}
+	return err
+}
+
+// DLQReplay publishes matching messages back to the main exchange with their
+// retry headers reset, and removes them from the DLQ once confirmed.
+func DLQReplay(payload *DLQPayload) error {
+	if payload.Filter.empty() && !payload.All {
+		return errors.New("replay needs a filter or -all")
+	}
+
+	pubCh, err := payload.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer pubCh.Close()
+	confirmCh, err := NewConfirmChannel(pubCh)
+	if err != nil {
+		return err
+	}
+
+	mainExchange := util.GetExchangeName(payload.Topic, util.Events)
+	routingKey := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
+	now := time.Now()
+	replayed, skipped := 0, 0
+
+	err = browseDLQ(payload, func(d amqp.Delivery) (bool, error) {
+		if !payload.Filter.Match(NewDLQMessage(d), now) {
+			skipped++
+			return false, nil
+		}
+
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		for _, k := range retryHeaders {
+			delete(headers, k)
+		}
+		headers[HeaderReplayedAt] = now
+
+		if err := confirmCh.Publish(context.Background(), mainExchange, routingKey, amqp.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: d.CorrelationId,
+			MessageId:     d.MessageId,
+			Timestamp:     d.Timestamp,
+			Type:          d.Type,
+			AppId:         d.AppId,
+			Body:          d.Body,
+		}); err != nil {
+			return false, fmt.Errorf("replay message %s: %w", d.MessageId, err)
+		}
+		replayed++
+		return true, d.Ack(false)
+	})
+
+	fmt.Printf("Replayed %d messages to %s, left %d in the DLQ\n", replayed, mainExchange, skipped)
+	return err
+}
+
+// DLQPurge deletes every message in the DLQ
+func DLQPurge(payload *DLQPayload) error {
+	if !payload.Force {
+		return errors.New("purge deletes messages permanently; pass -force to confirm (consider -action dlq-export first)")
+	}
+	dlqName := util.GetQueueName(payload.Topic, "main", util.DLQ)
+
+	ch, err := payload.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	n, err := ch.QueuePurge(dlqName, false)
+	if err != nil {
+		return fmt.Errorf("purge %s: %w", dlqName, err)
+	}
+	fmt.Printf("Purged %d messages from %s\n", n, dlqName)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDLQPeekRefusesQuorumDLQ(t *testing.T) {
+	queues := []BrokerQueue{
+		{Name: "q.orders.main.dlq", Type: "quorum"},
+		{Name: "q.audit.main.dlq", Type: "classic"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(queues)
+	}))
+	defer server.Close()
+	management := &ManagementClient{BaseURL: server.URL, Vhost: "/", HTTP: server.Client()}
+
+	err := DLQPeek(&DLQPayload{Management: management, Topic: "orders"})
+	if err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("peek of a quorum DLQ = %v, want an error pointing to -force", err)
+	}
+
+	tests := []struct {
+		name    string
+		payload DLQPayload
+	}{
+		{"classic", DLQPayload{Topic: "audit"}},
+		{"forced", DLQPayload{Topic: "orders", Force: true}},
+		{"replay all", DLQPayload{Topic: "orders", All: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.payload.Management = management
+			if err := checkRequeueSafe(&tt.payload, "q."+tt.payload.Topic+".main.dlq"); err != nil {
+				t.Errorf("checkRequeueSafe() = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Envelope headers for the fields without a matching AMQP property
+const (
+	HeaderMessageVersion = "x-message-version"
+	HeaderCausationID    = "x-causation-id"
+)
+
+// Envelope is the metadata every message carries next to its body. It is
+// stored in the AMQP properties, so the body stays the plain payload:
+//
+//	MessageID     message-id
+//	Type          type
+//	Version       x-message-version header
+//	Timestamp     timestamp
+//	Source        app-id, the publishing service
+//	CorrelationID correlation-id, shared by every message of one flow
+//	CausationID   x-causation-id header, the message-id this one reacts to
+type Envelope struct {
+	MessageID     string
+	Type          string
+	Version       string
+	Timestamp     time.Time
+	Source        string
+	CorrelationID string
+	CausationID   string
+}
+
+// NewEnvelope starts a new flow: the message is its own correlation ID
+func NewEnvelope(source, msgType, version string) Envelope {
+	id := newMessageID()
+	return Envelope{
+		MessageID:     id,
+		Type:          msgType,
+		Version:       version,
+		Timestamp:     time.Now().UTC(),
+		Source:        source,
+		CorrelationID: id,
+	}
+}
+
+// CausedBy returns an envelope for a message published in reaction to
+// parent. It keeps parent's correlation ID and records parent as the cause.
+func (e Envelope) CausedBy(parent Envelope) Envelope {
+	e.CorrelationID = parent.CorrelationID
+	if e.CorrelationID == "" {
+		e.CorrelationID = parent.MessageID
+	}
+	e.CausationID = parent.MessageID
+	return e
+}
+
+// Apply stores the envelope in msg's properties and headers
+func (e Envelope) Apply(msg *amqp.Publishing) {
+	if e.MessageID == "" {
+		e.MessageID = newMessageID()
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	msg.MessageId = e.MessageID
+	msg.Type = e.Type
+	msg.Timestamp = e.Timestamp
+	msg.AppId = e.Source
+	msg.CorrelationId = e.CorrelationID
+
+	if e.Version == "" && e.CausationID == "" {
+		return
+	}
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if e.Version != "" {
+		headers[HeaderMessageVersion] = e.Version
+	}
+	if e.CausationID != "" {
+		headers[HeaderCausationID] = e.CausationID
+	}
+	msg.Headers = headers
+}
+
+// EnvelopeOf reads the envelope of a delivery
+func EnvelopeOf(d amqp.Delivery) Envelope {
+	e := Envelope{
+		MessageID:     d.MessageId,
+		Type:          d.Type,
+		Timestamp:     d.Timestamp,
+		Source:        d.AppId,
+		CorrelationID: d.CorrelationId,
+	}
+	e.Version, _ = d.Headers[HeaderMessageVersion].(string)
+	e.CausationID, _ = d.Headers[HeaderCausationID].(string)
+	return e
+}
+
+// forward copies a delivery into a new publishing with the given headers,
+// keeping its envelope, so a message moved to a retry queue or the DLQ is
+// still the same message.
+func forward(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	contentType := d.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return amqp.Publishing{
+		ContentType:   contentType,
+		Body:          d.Body,
+		Headers:       headers,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     d.MessageId,
+		Type:          d.Type,
+		Timestamp:     d.Timestamp,
+		AppId:         d.AppId,
+		CorrelationId: d.CorrelationId,
+	}
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// fakeBroker is an in-memory broker for tests. It implements the default,
+// direct, topic, fanout, headers, consistent-hash and delayed-message
+// exchanges, exchange-to-exchange bindings, manual acks, dead-lettering with
+// x-death headers, length limits with x-overflow, and queue and per-message
+// TTLs and delays on a virtual clock moved by Advance.
+// It is also a Consumer and a PublisherConn, so subscribers and publisher
+// pools can run against it.
+type fakeBroker struct {
+	mu        sync.Mutex
+	now       time.Time
+	exchanges map[string]*fakeExchange
+	queues    map[string]*fakeQueue
+	unacked   map[uint64]fakeUnacked
+	lastTag   uint64
+	lastQueue int
+	returned  []amqp.Return
+	delayed   []*fakeMessage // held by x-delayed-message exchanges, enqueued is when they are due
+	enqueued  chan struct{}  // closed and replaced whenever a message is enqueued
+	unblocked chan struct{}  // closed while publishing is not blocked
+}
+
+type fakeExchange struct {
+	kind     string
+	args     amqp.Table
+	bindings []fakeBinding
+}
+
+// fakeBinding binds a queue, or an exchange when exchange is set
+type fakeBinding struct {
+	queue    string
+	exchange string
+	key      string
+	args     amqp.Table
+}
+
+type fakeQueue struct {
+	name     string
+	args     amqp.Table
+	messages []*fakeMessage
+}
+
+type fakeMessage struct {
+	exchange    string
+	routingKey  string
+	msg         amqp.Publishing
+	enqueued    time.Time
+	redelivered bool
+}
+
+type fakeUnacked struct {
+	queue string
+	m     *fakeMessage
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		now:       time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		exchanges: map[string]*fakeExchange{},
+		queues:    map[string]*fakeQueue{},
+		unacked:   map[uint64]fakeUnacked{},
+		enqueued:  make(chan struct{}),
+		unblocked: closedChan(),
+	}
+}
+
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// Channel returns a channel on the broker. Every channel shares the broker's
+// state, and Publish waits for nothing since routing is synchronous.
+func (b *fakeBroker) Channel() *fakeChannel {
+	return &fakeChannel{b: b}
+}
+
+// ConfirmChannel returns a channel on the broker
+func (b *fakeBroker) ConfirmChannel() (ConfirmPublisher, error) {
+	return b.Channel(), nil
+}
+
+// SetBlocked blocks or unblocks publishing, like connection.blocked and
+// connection.unblocked
+func (b *fakeBroker) SetBlocked(blocked bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.unblocked:
+		if blocked {
+			b.unblocked = make(chan struct{})
+		}
+	default:
+		if !blocked {
+			close(b.unblocked)
+		}
+	}
+}
+
+// WaitUnblocked returns once publishing is not blocked
+func (b *fakeBroker) WaitUnblocked(ctx context.Context) error {
+	b.mu.Lock()
+	unblocked := b.unblocked
+	b.mu.Unlock()
+	select {
+	case <-unblocked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Advance moves the clock forward and expires messages whose TTL has passed
+func (b *fakeBroker) Advance(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.now = b.now.Add(d)
+	b.expire()
+}
+
+// Get takes the next message of a queue, like basic.get without auto-ack
+func (b *fakeBroker) Get(queue string) (amqp.Delivery, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	q, ok := b.queues[queue]
+	if !ok || len(q.messages) == 0 {
+		return amqp.Delivery{}, false
+	}
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	b.lastTag++
+	b.unacked[b.lastTag] = fakeUnacked{queue: queue, m: m}
+
+	msg := m.msg
+	return amqp.Delivery{
+		Acknowledger:    b,
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		DeliveryTag:     b.lastTag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            msg.Body,
+	}, true
+}
+
+// Len returns the number of ready messages in a queue
+func (b *fakeBroker) Len(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	if q, ok := b.queues[queue]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// Unacked returns the number of delivered messages that were not acked yet
+func (b *fakeBroker) Unacked() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.unacked)
+}
+
+// HasQueue reports whether a queue was declared
+func (b *fakeBroker) HasQueue(queue string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.queues[queue]
+	return ok
+}
+
+// Returned returns the mandatory messages that matched no queue
+func (b *fakeBroker) Returned() []amqp.Return {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]amqp.Return(nil), b.returned...)
+}
+
+// Consume runs fn for every message of the queue returned by opts.Setup
+// until ctx is done
+func (b *fakeBroker) Consume(ctx context.Context, opts ConsumeOptions, fn DeliveryFunc) error {
+	ch := b.Channel()
+	queue, err := opts.Setup(ch)
+	if err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		b.mu.Lock()
+		enqueued := b.enqueued
+		b.mu.Unlock()
+
+		if d, ok := b.Get(queue); ok {
+			fn(ctx, ch, d)
+			continue
+		}
+		select {
+		case <-enqueued:
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+func (b *fakeBroker) Ack(tag uint64, multiple bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.settle(tag, multiple)
+	return err
+}
+
+func (b *fakeBroker) Nack(tag uint64, multiple, requeue bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settled, err := b.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, u := range settled {
+		q, ok := b.queues[u.queue]
+		if !ok {
+			continue
+		}
+		if requeue {
+			u.m.redelivered = true
+			q.messages = append([]*fakeMessage{u.m}, q.messages...)
+			b.signal()
+			continue
+		}
+		b.deadLetter(q, u.m, "rejected")
+	}
+	return nil
+}
+
+func (b *fakeBroker) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
+
+// settle removes tag, or every tag up to it when multiple is set, from the
+// unacked messages and returns them in delivery order
+func (b *fakeBroker) settle(tag uint64, multiple bool) ([]fakeUnacked, error) {
+	if _, ok := b.unacked[tag]; !ok {
+		return nil, fmt.Errorf("PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+	if !multiple {
+		u := b.unacked[tag]
+		delete(b.unacked, tag)
+		return []fakeUnacked{u}, nil
+	}
+	var tags []uint64
+	for t := range b.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	settled := make([]fakeUnacked, 0, len(tags))
+	for _, t := range tags {
+		settled = append(settled, b.unacked[t])
+		delete(b.unacked, t)
+	}
+	return settled, nil
+}
+
+func (b *fakeBroker) signal() {
+	close(b.enqueued)
+	b.enqueued = make(chan struct{})
+}
+
+// route returns the queues a message published to exchange with key goes to
+func (b *fakeBroker) route(exchange, key string, headers amqp.Table) ([]string, error) {
+	if exchange == "" {
+		if _, ok := b.queues[key]; ok {
+			return []string{key}, nil
+		}
+		return nil, nil
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, fmt.Errorf("NOT_FOUND - no exchange '%s'", exchange)
+	}
+	kind := ex.kind
+	if kind == DelayedMessageExchange {
+		kind, _ = ex.args["x-delayed-type"].(string)
+	}
+	if kind == ConsistentHashExchange {
+		return consistentHash(ex.bindings, key), nil
+	}
+	seen := map[string]bool{}
+	var queues []string
+	for _, binding := range ex.bindings {
+		var match bool
+		switch kind {
+		case "fanout":
+			match = true
+		case "topic":
+			match = topicMatch(strings.Split(binding.key, "."), strings.Split(key, "."))
+		case "headers":
+			match = headersMatch(binding.args, headers)
+		default:
+			match = binding.key == key
+		}
+		if !match {
+			continue
+		}
+		targets := []string{binding.queue}
+		if binding.exchange != "" {
+			var err error
+			if targets, err = b.route(binding.exchange, key, headers); err != nil {
+				return nil, err
+			}
+		}
+		for _, queue := range targets {
+			if !seen[queue] {
+				seen[queue] = true
+				queues = append(queues, queue)
+			}
+		}
+	}
+	return queues, nil
+}
+
+// topicMatch matches a routing key against a binding pattern, where * is one
+// word and # is zero or more words
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+}
+
+// consistentHash picks one binding for key, weighted by the binding keys.
+// It is stable for a key like the plugin's hash ring, but not the same hash.
+func consistentHash(bindings []fakeBinding, key string) []string {
+	total := 0
+	for _, binding := range bindings {
+		weight, _ := strconv.Atoi(binding.key)
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	point := int(h.Sum32() % uint32(total))
+	for _, binding := range bindings {
+		weight, _ := strconv.Atoi(binding.key)
+		if point < weight {
+			return []string{binding.queue}
+		}
+		point -= weight
+	}
+	return nil
+}
+
+// headersMatch matches message headers against the arguments of a headers
+// exchange binding. Arguments starting with x- are not matched.
+func headersMatch(args, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+	matched, total := 0, 0
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		total++
+		if hv, ok := headers[k]; ok && hv == v {
+			matched++
+		}
+	}
+	if matchAny {
+		return matched > 0
+	}
+	return matched == total
+}
+
+// publish routes msg and reports whether any queue received it, and whether
+// a full queue with x-overflow reject-publish refused it. Messages for a
+// delayed-message exchange are held for their x-delay and count as not
+// routed, like the plugin, which returns mandatory messages.
+func (b *fakeBroker) publish(exchange, key string, msg amqp.Publishing) (routed, rejected bool, err error) {
+	if ex, ok := b.exchanges[exchange]; ok && ex.kind == DelayedMessageExchange {
+		delay, _ := toInt(msg.Headers["x-delay"])
+		due := b.now.Add(time.Duration(delay) * time.Millisecond)
+		b.delayed = append(b.delayed, &fakeMessage{exchange: exchange, routingKey: key, msg: msg, enqueued: due})
+		return false, false, nil
+	}
+	return b.deliver(exchange, key, msg)
+}
+
+// deliver routes msg to its queues
+func (b *fakeBroker) deliver(exchange, key string, msg amqp.Publishing) (routed, rejected bool, err error) {
+	queues, err := b.route(exchange, key, msg.Headers)
+	if err != nil {
+		return false, false, err
+	}
+	for _, name := range queues {
+		m := &fakeMessage{exchange: exchange, routingKey: key, msg: msg, enqueued: b.now}
+		m.msg.Headers = copyTable(msg.Headers)
+		if !b.enqueue(b.queues[name], m) {
+			rejected = true
+		}
+	}
+	if len(queues) > 0 {
+		b.signal()
+	}
+	return len(queues) > 0, rejected, nil
+}
+
+// enqueue adds m to q within its x-max-length and x-max-length-bytes. When
+// q is full it dead-letters its oldest messages (drop-head), or refuses m
+// (reject-publish) and dead-letters it (reject-publish-dlx).
+func (b *fakeBroker) enqueue(q *fakeQueue, m *fakeMessage) bool {
+	maxLength, hasMaxLength := toInt(q.args["x-max-length"])
+	maxBytes, hasMaxBytes := toInt(q.args["x-max-length-bytes"])
+	over := func(extra *fakeMessage) bool {
+		n, size := len(q.messages), 0
+		for _, queued := range q.messages {
+			size += len(queued.msg.Body)
+		}
+		if extra != nil {
+			n, size = n+1, size+len(extra.msg.Body)
+		}
+		return (hasMaxLength && n > maxLength) || (hasMaxBytes && size > maxBytes)
+	}
+
+	switch q.args["x-overflow"] {
+	case string(util.RejectPublish), string(util.RejectPublishDLX):
+		if over(m) {
+			if q.args["x-overflow"] == string(util.RejectPublishDLX) {
+				b.deadLetter(q, m, "maxlen")
+			}
+			return false
+		}
+		q.messages = append(q.messages, m)
+	default:
+		q.messages = append(q.messages, m)
+		for len(q.messages) > 0 && over(nil) {
+			head := q.messages[0]
+			q.messages = q.messages[1:]
+			b.deadLetter(q, head, "maxlen")
+		}
+	}
+	return true
+}
+
+// expire routes delayed messages that are due and dead-letters messages
+// whose queue or per-message TTL has passed. Dead-lettered messages can
+// expire again in their next queue, so it runs until nothing changes.
+func (b *fakeBroker) expire() {
+	for changed := true; changed; {
+		changed = false
+
+		var held []*fakeMessage
+		for _, m := range b.delayed {
+			if b.now.Before(m.enqueued) {
+				held = append(held, m)
+				continue
+			}
+			_, _, _ = b.deliver(m.exchange, m.routingKey, m.msg)
+			changed = true
+		}
+		b.delayed = held
+		names := make([]string, 0, len(b.queues))
+		for name := range b.queues {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			q := b.queues[name]
+			queueTTL, hasQueueTTL := toInt(q.args["x-message-ttl"])
+			var kept []*fakeMessage
+			var expired []*fakeMessage
+			for _, m := range q.messages {
+				ttl, hasTTL := queueTTL, hasQueueTTL
+				if ms, err := strconv.Atoi(m.msg.Expiration); err == nil && (!hasTTL || ms < ttl) {
+					ttl, hasTTL = ms, true
+				}
+				if hasTTL && !b.now.Before(m.enqueued.Add(time.Duration(ttl)*time.Millisecond)) {
+					expired = append(expired, m)
+				} else {
+					kept = append(kept, m)
+				}
+			}
+			if len(expired) == 0 {
+				continue
+			}
+			q.messages = kept
+			for _, m := range expired {
+				b.deadLetter(q, m, "expired")
+			}
+			changed = true
+		}
+	}
+}
+
+// deadLetter republishes m to the queue's dead-letter exchange with an
+// updated x-death header, or drops it when the queue has none
+func (b *fakeBroker) deadLetter(q *fakeQueue, m *fakeMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.routingKey
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+
+	msg := m.msg
+	headers := copyTable(msg.Headers)
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	var entry amqp.Table
+	rest := make([]interface{}, 0, len(deaths)+1)
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && entry == nil && t["queue"] == q.name && t["reason"] == reason {
+			entry = copyTable(t)
+			continue
+		}
+		rest = append(rest, d)
+	}
+	if entry == nil {
+		entry = amqp.Table{
+			"queue":        q.name,
+			"reason":       reason,
+			"exchange":     m.exchange,
+			"routing-keys": []interface{}{m.routingKey},
+			"count":        int64(0),
+		}
+	}
+	entry["count"] = entry["count"].(int64) + 1
+	entry["time"] = b.now
+	if msg.Expiration != "" {
+		entry["original-expiration"] = msg.Expiration
+		msg.Expiration = ""
+	}
+	headers["x-death"] = append([]interface{}{entry}, rest...)
+	if _, ok := headers["x-first-death-queue"]; !ok {
+		headers["x-first-death-queue"] = q.name
+		headers["x-first-death-reason"] = reason
+		headers["x-first-death-exchange"] = m.exchange
+	}
+	headers["x-last-death-queue"] = q.name
+	headers["x-last-death-reason"] = reason
+	headers["x-last-death-exchange"] = m.exchange
+	msg.Headers = headers
+
+	// A missing dead-letter exchange drops the message, like RabbitMQ
+	_, _, _ = b.publish(dlx, key, msg)
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	if t == nil {
+		return nil
+	}
+	out := amqp.Table{}
+	for k, v := range t {
+		out[k] = v
+	}
+	return out
+}
+
+// fakeChannel implements Channel and ConfirmPublisher on a fakeBroker
+type fakeChannel struct {
+	b *fakeBroker
+}
+
+func (c *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if ex, ok := c.b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return fmt.Errorf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s': received '%s' but current is '%s'", name, kind, ex.kind)
+		}
+		return nil
+	}
+	switch kind {
+	case "direct", "topic", "fanout", "headers", ConsistentHashExchange:
+	case DelayedMessageExchange:
+		if _, ok := args["x-delayed-type"].(string); !ok {
+			return fmt.Errorf("PRECONDITION_FAILED - Invalid argument, 'x-delayed-type' must be an existing exchange type")
+		}
+	default:
+		return fmt.Errorf("COMMAND_INVALID - unknown exchange type '%s'", kind)
+	}
+	c.b.exchanges[name] = &fakeExchange{kind: kind, args: copyTable(args)}
+	return nil
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if name == "" {
+		c.b.lastQueue++
+		name = fmt.Sprintf("amq.gen-%d", c.b.lastQueue)
+	}
+	q, ok := c.b.queues[name]
+	if !ok {
+		q = &fakeQueue{name: name, args: copyTable(args)}
+		c.b.queues[name] = q
+	} else if q.args["x-queue-type"] != args["x-queue-type"] {
+		return amqp.Queue{}, fmt.Errorf("PRECONDITION_FAILED - inequivalent arg 'x-queue-type' for queue '%s'", name)
+	}
+	return amqp.Queue{Name: name, Messages: len(q.messages)}, nil
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	ex, ok := c.b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("NOT_FOUND - no exchange '%s'", exchange)
+	}
+	if _, ok := c.b.queues[name]; !ok {
+		return fmt.Errorf("NOT_FOUND - no queue '%s'", name)
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key && reflect.DeepEqual(binding.args, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, fakeBinding{queue: name, key: key, args: copyTable(args)})
+	return nil
+}
+
+func (c *fakeChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	ex, ok := c.b.exchanges[source]
+	if !ok {
+		return fmt.Errorf("NOT_FOUND - no exchange '%s'", source)
+	}
+	if _, ok := c.b.exchanges[destination]; !ok {
+		return fmt.Errorf("NOT_FOUND - no exchange '%s'", destination)
+	}
+	for _, binding := range ex.bindings {
+		if binding.exchange == destination && binding.key == key && reflect.DeepEqual(binding.args, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, fakeBinding{exchange: destination, key: key, args: copyTable(args)})
+	return nil
+}
+
+func (c *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	routed, _, err := c.b.publish(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if !routed && mandatory {
+		c.b.returned = append(c.b.returned, amqp.Return{
+			ReplyCode:  312,
+			ReplyText:  "NO_ROUTE",
+			Exchange:   exchange,
+			RoutingKey: key,
+			MessageId:  msg.MessageId,
+			Body:       msg.Body,
+		})
+	}
+	return nil
+}
+
+// Publish is the confirmed, mandatory publish of ConfirmChannel
+func (c *fakeChannel) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if msg.MessageId == "" {
+		msg.MessageId = newMessageID()
+	}
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	routed, rejected, err := c.b.publish(exchange, routingKey, msg)
+	if err != nil {
+		return err
+	}
+	if !routed {
+		return &ReturnedError{Exchange: exchange, RoutingKey: routingKey, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	}
+	if rejected {
+		return &NackedError{Exchange: exchange, RoutingKey: routingKey}
+	}
+	return nil
+}
+
+var (
+	_ ConfirmPublisher  = (*fakeChannel)(nil)
+	_ Consumer          = (*fakeBroker)(nil)
+	_ PublisherConn     = (*fakeBroker)(nil)
+	_ amqp.Acknowledger = (*fakeBroker)(nil)
+)
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// keyValues parses key=value flag values into a map
+func (l stringList) keyValues(flagName string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range l {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("-%s must be key=value, got '%s'", flagName, kv)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Handler processes a single delivery. Returning nil acks the message,
+// returning an error hands it to the nack / retry / DLQ flow.
+type Handler interface {
+	Handle(ctx context.Context, d amqp.Delivery) error
+}
+
+// HandlerFunc adapts a plain function to the Handler interface
+type HandlerFunc func(ctx context.Context, d amqp.Delivery) error
+
+func (f HandlerFunc) Handle(ctx context.Context, d amqp.Delivery) error {
+	return f(ctx, d)
+}
+
+// LogHandler is used for topics without a registered handler
+var LogHandler = HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+	env := EnvelopeOf(d)
+	if env.Type == "" {
+		log.Printf("consumed: %v", string(d.Body))
+		return nil
+	}
+	log.Printf("consumed %s v%s (id %s, from %s, correlation %s): %v",
+		env.Type, env.Version, env.MessageID, env.Source, env.CorrelationID, string(d.Body))
+	return nil
+})
+
+// JSONHandler decodes the body into T before calling fn. Bodies that cannot
+// be decoded are reported as ErrInvalidPayload so they skip the retry path.
+func JSONHandler[T any](fn func(ctx context.Context, msg T, d amqp.Delivery) error) Handler {
+	return HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		var msg T
+		if err := json.Unmarshal(d.Body, &msg); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+		}
+		return fn(ctx, msg, d)
+	})
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]Handler{}
+)
+
+// RegisterHandler sets the handler used by every subscriber of topic
+func RegisterHandler(topic string, h Handler) {
+	if topic == "" {
+		panic("topic is required")
+	}
+	if h == nil {
+		panic("handler is required")
+	}
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[topic] = h
+}
+
+// HandlerFor returns the handler registered for topic, or LogHandler
+func HandlerFor(topic string) Handler {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	if h, ok := handlers[topic]; ok {
+		return h
+	}
+	return LogHandler
+}
+
+// Error classification
+
+var (
+	// ErrPermanent marks failures that will never succeed on retry
+	ErrPermanent = errors.New("permanent failure")
+	// ErrInvalidPayload is returned for bodies that cannot be decoded
+	ErrInvalidPayload = fmt.Errorf("%w: invalid payload", ErrPermanent)
+	// ErrValidation is returned for decoded messages that fail validation
+	ErrValidation = fmt.Errorf("%w: validation failed", ErrPermanent)
+)
+
+// PermanentError wraps an error so that IsPermanent reports true for it
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return "permanent failure: " + e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PermanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// Permanent wraps err as a permanent failure. A nil err stays nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err should skip retries and go straight to the DLQ.
+// JSON decoding errors are treated as permanent even when not wrapped.
+func IsPermanent(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrPermanent) {
+		return true
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
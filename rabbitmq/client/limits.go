@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// QueueLimits bound how much a queue holds and how long. Zero values are
+// not set.
+type QueueLimits struct {
+	MaxLength      int64         `json:"max_length,omitempty" yaml:"max_length,omitempty"`             // x-max-length, in messages
+	MaxLengthBytes int64         `json:"max_length_bytes,omitempty" yaml:"max_length_bytes,omitempty"` // x-max-length-bytes, of message bodies
+	Overflow       util.Overflow `json:"overflow,omitempty" yaml:"overflow,omitempty"`                 // x-overflow, defaults to drop-head
+	MessageTTL     int64         `json:"message_ttl_ms,omitempty" yaml:"message_ttl_ms,omitempty"`     // x-message-ttl
+	Expires        int64         `json:"expires_ms,omitempty" yaml:"expires_ms,omitempty"`             // x-expires, deletes the queue when unused this long
+}
+
+// IsZero reports whether no limit is set
+func (l QueueLimits) IsZero() bool {
+	return l == QueueLimits{}
+}
+
+// Validate checks the limits against the queue type
+func (l QueueLimits) Validate(kind util.QueueKind) error {
+	if l.MaxLength < 0 || l.MaxLengthBytes < 0 || l.MessageTTL < 0 || l.Expires < 0 {
+		return errors.New("queue limits must not be negative")
+	}
+	if _, err := util.ParseOverflow(string(l.Overflow)); err != nil {
+		return err
+	}
+	if l.Overflow != "" && l.MaxLength == 0 && l.MaxLengthBytes == 0 {
+		return errors.New("overflow requires max_length or max_length_bytes")
+	}
+	switch kind {
+	case util.QuorumQueue:
+		if l.Overflow == util.RejectPublishDLX {
+			return errors.New("quorum queues do not support overflow reject-publish-dlx")
+		}
+	case util.StreamQueue:
+		if l.MaxLength > 0 || l.Overflow != "" || l.MessageTTL > 0 || l.Expires > 0 {
+			return errors.New("stream queues only support max_length_bytes, use x-max-age for retention")
+		}
+	}
+	return nil
+}
+
+// apply adds the limits to queue declaration arguments
+func (l QueueLimits) apply(args amqp.Table) {
+	if l.MaxLength > 0 {
+		args["x-max-length"] = l.MaxLength
+	}
+	if l.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = l.MaxLengthBytes
+	}
+	if l.Overflow != "" {
+		args["x-overflow"] = string(l.Overflow)
+	}
+	if l.MessageTTL > 0 {
+		args["x-message-ttl"] = l.MessageTTL
+	}
+	if l.Expires > 0 {
+		args["x-expires"] = l.Expires
+	}
+}
+
+// merge returns l with the limits set in other
+func (l QueueLimits) merge(other QueueLimits) QueueLimits {
+	if other.MaxLength > 0 {
+		l.MaxLength = other.MaxLength
+	}
+	if other.MaxLengthBytes > 0 {
+		l.MaxLengthBytes = other.MaxLengthBytes
+	}
+	if other.Overflow != "" {
+		l.Overflow = other.Overflow
+	}
+	if other.MessageTTL > 0 {
+		l.MessageTTL = other.MessageTTL
+	}
+	if other.Expires > 0 {
+		l.Expires = other.Expires
+	}
+	return l
+}
+
+// ParseQueueLimits parses a comma-separated list of limits, e.g.
+// "max-length=10000,max-length-bytes=512mb,overflow=reject-publish,message-ttl=24h,expires=1h".
+// Sizes take a kb, mb or gb suffix (powers of 1024), durations are whole
+// milliseconds.
+func ParseQueueLimits(s string) (QueueLimits, error) {
+	var l QueueLimits
+	if s == "" {
+		return l, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return QueueLimits{}, fmt.Errorf("invalid queue limit %q, must be key=value", item)
+		}
+		var err error
+		switch key {
+		case "max-length":
+			l.MaxLength, err = strconv.ParseInt(value, 10, 64)
+		case "max-length-bytes":
+			l.MaxLengthBytes, err = parseSize(value)
+		case "overflow":
+			l.Overflow, err = util.ParseOverflow(value)
+		case "message-ttl":
+			l.MessageTTL, err = parseMillis(value)
+		case "expires":
+			l.Expires, err = parseMillis(value)
+		default:
+			return QueueLimits{}, fmt.Errorf("unknown queue limit %q, must be max-length, max-length-bytes, overflow, message-ttl or expires", key)
+		}
+		if err != nil {
+			return QueueLimits{}, fmt.Errorf("invalid queue limit %q: %w", item, err)
+		}
+	}
+	if l.MaxLength < 0 {
+		return QueueLimits{}, errors.New("max-length must not be negative")
+	}
+	return l, nil
+}
+
+// parseSize parses a byte count with an optional kb, mb or gb suffix
+func parseSize(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+		if strings.HasSuffix(lower, suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("size %q must be a positive number of bytes, kb, mb or gb", s)
+	}
+	return n * multiplier, nil
+}
+
+// parseMillis parses a positive duration of whole milliseconds
+func parseMillis(s string) (int64, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 || d%time.Millisecond != 0 {
+		return 0, fmt.Errorf("%s must be a positive number of milliseconds", d)
+	}
+	return d.Milliseconds(), nil
+}
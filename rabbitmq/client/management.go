@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/config"
+)
+
+// ManagementClient reads broker state from the RabbitMQ management HTTP API.
+// AMQP can only check that an entity exists, not what it was declared with.
+type ManagementClient struct {
+	BaseURL  string
+	Username string
+	Password string
+	Vhost    string
+	HTTP     *http.Client
+}
+
+// NewManagementClient uses the credentials, vhost and TLS settings of the
+// connection config
+func NewManagementClient(cfg *config.RabbitMQConfig) (*ManagementClient, error) {
+	tlsConfig, err := cfg.TLSClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	username, password := cfg.Credentials()
+	return &ManagementClient{
+		BaseURL:  strings.TrimRight(cfg.ManagementURL, "/"),
+		Username: username,
+		Password: password,
+		Vhost:    cfg.VirtualHost(),
+		HTTP: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+type BrokerExchange struct {
+	Name       string                 `json:"name"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+type BrokerQueue struct {
+	Name       string                 `json:"name"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Exclusive  bool                   `json:"exclusive"`
+	Arguments  map[string]interface{} `json:"arguments"`
+	Messages   int                    `json:"messages"`
+}
+
+type BrokerBinding struct {
+	Source          string                 `json:"source"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// BrokerState is a snapshot of the entities in one vhost
+type BrokerState struct {
+	Exchanges []BrokerExchange
+	Queues    []BrokerQueue
+	Bindings  []BrokerBinding
+}
+
+func (m *ManagementClient) Exchanges(ctx context.Context) ([]BrokerExchange, error) {
+	var out []BrokerExchange
+	return out, m.get(ctx, "/api/exchanges/"+url.PathEscape(m.Vhost), &out)
+}
+
+func (m *ManagementClient) Queues(ctx context.Context) ([]BrokerQueue, error) {
+	var out []BrokerQueue
+	return out, m.get(ctx, "/api/queues/"+url.PathEscape(m.Vhost), &out)
+}
+
+func (m *ManagementClient) Bindings(ctx context.Context) ([]BrokerBinding, error) {
+	var out []BrokerBinding
+	return out, m.get(ctx, "/api/bindings/"+url.PathEscape(m.Vhost), &out)
+}
+
+// State fetches exchanges, queues and bindings of the vhost
+func (m *ManagementClient) State(ctx context.Context) (*BrokerState, error) {
+	var state BrokerState
+	var err error
+	if state.Exchanges, err = m.Exchanges(ctx); err != nil {
+		return nil, err
+	}
+	if state.Queues, err = m.Queues(ctx); err != nil {
+		return nil, err
+	}
+	if state.Bindings, err = m.Bindings(ctx); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (m *ManagementClient) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(m.Username, m.Password)
+
+	resp, err := m.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("management API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("management API %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
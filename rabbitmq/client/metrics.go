@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// clientMetrics are the client-side counters and histograms. They are
+// created on the global meter, so they record nothing until InitMetrics sets
+// a meter provider.
+type clientMetrics struct {
+	published     metric.Int64Counter
+	confirmed     metric.Int64Counter
+	returned      metric.Int64Counter
+	publishNacked metric.Int64Counter
+	consumed      metric.Int64Counter
+	acked         metric.Int64Counter
+	nacked        metric.Int64Counter
+	retried       metric.Int64Counter
+	deadLettered  metric.Int64Counter
+	handlerTime   metric.Float64Histogram
+
+	breakerState       metric.Int64Gauge
+	breakerTransitions metric.Int64Counter
+}
+
+var metrics = newClientMetrics(otel.Meter("rabbitmq-client"))
+
+func newClientMetrics(m metric.Meter) *clientMetrics {
+	counter := func(name, desc string) metric.Int64Counter {
+		c, err := m.Int64Counter(name, metric.WithDescription(desc), metric.WithUnit("{message}"))
+		if err != nil {
+			panic(err)
+		}
+		return c
+	}
+	handlerTime, err := m.Float64Histogram("rabbitmq.client.handler.duration",
+		metric.WithDescription("Time spent in message handlers"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30),
+	)
+	if err != nil {
+		panic(err)
+	}
+	breakerState, err := m.Int64Gauge("rabbitmq.client.breaker.state",
+		metric.WithDescription("Circuit breaker state: 0 closed, 1 open, 2 half-open"),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return &clientMetrics{
+		published:     counter("rabbitmq.client.published", "Messages sent to the broker"),
+		confirmed:     counter("rabbitmq.client.confirmed", "Published messages acked by the broker"),
+		returned:      counter("rabbitmq.client.returned", "Published messages returned as unroutable"),
+		publishNacked: counter("rabbitmq.client.publish.nacked", "Published messages nacked by the broker"),
+		consumed:      counter("rabbitmq.client.consumed", "Messages delivered to consumers"),
+		acked:         counter("rabbitmq.client.acked", "Deliveries acked"),
+		nacked:        counter("rabbitmq.client.nacked", "Deliveries nacked or rejected, by requeue"),
+		retried:       counter("rabbitmq.client.retried", "Messages sent to a retry tier, by attempt"),
+		deadLettered:  counter("rabbitmq.client.dead_lettered", "Messages moved to a DLQ, by cause"),
+		handlerTime:   handlerTime,
+
+		breakerState:       breakerState,
+		breakerTransitions: counter("rabbitmq.client.breaker.transitions", "Circuit breaker state changes, by new state"),
+	}
+}
+
+// InitMetrics sets the meter provider. With addr set, metrics are served for
+// Prometheus on http://<addr>/metrics; with otlpEndpoint set they are also
+// pushed over OTLP/HTTP. The returned function stops both.
+func InitMetrics(ctx context.Context, serviceName, addr, otlpEndpoint string) (func(context.Context) error, error) {
+	if addr == "" && otlpEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []sdkmetric.Option{
+		sdkmetric.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+		)),
+	}
+	if addr != "" {
+		exp, err := otelprom.New()
+		if err != nil {
+			return nil, fmt.Errorf("prometheus exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(exp))
+	}
+	if otlpEndpoint != "" {
+		exp, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(otlpEndpoint))
+		if err != nil {
+			return nil, fmt.Errorf("otlp metric exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp)))
+	}
+	provider := sdkmetric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(provider)
+
+	var server *http.Server
+	if addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		server = &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+		log.Printf("Serving metrics on http://%s/metrics", addr)
+	}
+
+	return func(ctx context.Context) error {
+		var errs []error
+		if server != nil {
+			errs = append(errs, server.Shutdown(ctx))
+		}
+		errs = append(errs, provider.Shutdown(ctx))
+		return errors.Join(errs...)
+	}, nil
+}
+
+type metricLabelsKey struct{}
+
+// withMetricLabels stores the service and queue of a consumer in ctx, for the
+// outcome metrics recorded by handleDelivery and ProcessWithRetry
+func withMetricLabels(ctx context.Context, service, queue string) context.Context {
+	return context.WithValue(ctx, metricLabelsKey{}, []attribute.KeyValue{
+		attribute.String("service", service),
+		attribute.String("queue", queue),
+	})
+}
+
+// metricLabels returns the consumer labels in ctx plus extra
+func metricLabels(ctx context.Context, extra ...attribute.KeyValue) metric.MeasurementOption {
+	labels, _ := ctx.Value(metricLabelsKey{}).([]attribute.KeyValue)
+	return metric.WithAttributes(append(append([]attribute.KeyValue{}, labels...), extra...)...)
+}
+
+// meteredAcknowledger counts acks and nacks of a delivery, wherever they happen
+type meteredAcknowledger struct {
+	amqp.Acknowledger
+	ctx context.Context
+}
+
+func (a meteredAcknowledger) Ack(tag uint64, multiple bool) error {
+	metrics.acked.Add(a.ctx, 1, metricLabels(a.ctx))
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a meteredAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	metrics.nacked.Add(a.ctx, 1, metricLabels(a.ctx, attribute.Bool("requeue", requeue)))
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a meteredAcknowledger) Reject(tag uint64, requeue bool) error {
+	metrics.nacked.Add(a.ctx, 1, metricLabels(a.ctx, attribute.Bool("requeue", requeue)))
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// meteredDelivery counts each delivery and its ack or nack, labelled with
+// service and the queue returned by queue()
+func meteredDelivery(service string, queue func() string, fn DeliveryFunc) DeliveryFunc {
+	return func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		ctx = withMetricLabels(ctx, service, queue())
+		metrics.consumed.Add(ctx, 1, metricLabels(ctx))
+		if d.Acknowledger != nil {
+			d.Acknowledger = meteredAcknowledger{Acknowledger: d.Acknowledger, ctx: ctx}
+		}
+		fn(ctx, ch, d)
+	}
+}
+
+// timedHandler records the handler latency, labelled by outcome
+func timedHandler(next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		start := time.Now()
+		err := next.Handle(ctx, d)
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		metrics.handlerTime.Record(ctx, time.Since(start).Seconds(), metricLabels(ctx, attribute.String("outcome", outcome)))
+		return err
+	})
+}
+
+// publishLabels labels publish metrics by service and exchange
+func publishLabels(exchange string) metric.MeasurementOption {
+	return metric.WithAttributes(
+		attribute.String("service", publishService(exchange)),
+		attribute.String("exchange", exchangeName(exchange)),
+	)
+}
+
+// publishService returns the service of an exchange named by
+// util.GetExchangeName, e.g. orders for events.orders.x, and "" for the
+// default exchange and other names
+func publishService(exchange string) string {
+	service, _, _ := util.ParseExchangeName(exchange)
+	return service
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// ConsistentHashExchange is the exchange type of the
+// rabbitmq_consistent_hash_exchange plugin. It hashes the routing key to
+// pick one of the bound queues, weighted by their binding keys.
+const ConsistentHashExchange = "x-consistent-hash"
+
+// PartitionQueue names sub-queue i of a partitioned subscriber,
+// q.<service>.<purpose>.p<i>
+func PartitionQueue(service, purpose string, i int) QueueRef {
+	return QueueRef{Name: util.GetQueueName(service, purpose, util.NormalQueue, fmt.Sprintf("p%d", i))}
+}
+
+// PartitionedTopology binds partitions sub-queues with equal weight to the
+// service's consistent-hash exchange, hash.<service>.x. Every sub-queue is
+// single active consumer and dead-letters to the DLQ.
+//
+// Changing the number of partitions moves some keys to another sub-queue,
+// so their ordering is only kept once the old sub-queue is drained.
+func PartitionedTopology(service, purpose string, partitions int) *Topology {
+	exchange := ExchangeRef{Service: service, Kind: util.Hash}
+	dlx := ExchangeRef{Service: service, Kind: util.DLX}
+	dlq := QueueRef{Service: service, Purpose: purpose, Kind: util.DLQ}
+
+	t := &Topology{
+		Exchanges: []ExchangeSpec{
+			{ExchangeRef: dlx, Type: "direct", Durable: true},
+			{ExchangeRef: exchange, Type: ConsistentHashExchange, Durable: true},
+		},
+		Queues:   []QueueSpec{{QueueRef: dlq, Durable: true}},
+		Bindings: []BindingSpec{{Exchange: dlx, Queue: dlq}},
+	}
+	for i := 0; i < partitions; i++ {
+		queue := PartitionQueue(service, purpose, i)
+		t.Queues = append(t.Queues, QueueSpec{
+			QueueRef:             queue,
+			Durable:              true,
+			SingleActiveConsumer: true,
+			DeadLetter:           &DeadLetterSpec{Exchange: dlx, Queue: &dlq},
+		})
+		// The binding key of a consistent-hash exchange is the weight
+		t.Bindings = append(t.Bindings, BindingSpec{Exchange: exchange, Queue: queue, RoutingKey: "1"})
+	}
+	return t
+}
+
+// ParsePartitionIDs parses a comma-separated list of partitions, e.g. 0,1,4
+func ParsePartitionIDs(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid partition %q", part)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("partition %d is listed twice", id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
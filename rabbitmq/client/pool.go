@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrPoolClosed is returned once Close has been called on a PublisherPool
+var ErrPoolClosed = errors.New("publisher pool closed")
+
+// PoolMessage is a message for PublisherPool.Publish
+type PoolMessage struct {
+	RoutingKey string // defaults to the main queue name; ignored by fanout and headers
+	amqp.Publishing
+}
+
+// PublisherPool publishes from any number of goroutines over a fixed set of
+// confirm channels on one connection. AMQP channels must not be shared by
+// concurrent publishers, so each publish has a channel to itself until its
+// confirm arrives, and waits for one when all are busy. A channel the broker
+// closed, e.g. after a reconnect, is reopened on its next use.
+//
+// While the broker blocks the connection (connection.blocked, raised by a
+// memory or disk alarm), publishers wait instead of piling up behind it.
+type PublisherPool struct {
+	conn      PublisherConn
+	channels  chan ConfirmPublisher // idle channels; nil is reopened when taken
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	declared map[string]string // exchange name -> type, declared by the pool
+}
+
+// NewPublisherPool opens size confirm channels on conn
+func NewPublisherPool(conn PublisherConn, size int) (*PublisherPool, error) {
+	size = max(size, 1)
+	p := &PublisherPool{
+		conn:     conn,
+		channels: make(chan ConfirmPublisher, size),
+		done:     make(chan struct{}),
+		declared: map[string]string{},
+	}
+	for i := 0; i < size; i++ {
+		ch, err := conn.ConfirmChannel()
+		if err != nil {
+			for len(p.channels) > 0 {
+				closeChannel(<-p.channels)
+			}
+			return nil, err
+		}
+		p.channels <- ch
+	}
+	return p, nil
+}
+
+// WithChannel runs fn with a channel that no other goroutine uses until fn
+// returns, such as for the Publisher methods. It waits while the broker
+// blocks publishing or every channel is busy.
+func (p *PublisherPool) WithChannel(ctx context.Context, fn func(ch ConfirmPublisher) error) error {
+	if err := p.conn.WaitUnblocked(ctx); err != nil {
+		return err
+	}
+
+	var ch ConfirmPublisher
+	select {
+	case ch = <-p.channels:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.done:
+		return ErrPoolClosed
+	}
+	select {
+	case <-p.done:
+		// Close is waiting for every channel
+		p.channels <- ch
+		return ErrPoolClosed
+	default:
+	}
+
+	if ch == nil || channelClosed(ch) {
+		var err error
+		if ch, err = p.conn.ConfirmChannel(); err != nil {
+			p.channels <- nil
+			return err
+		}
+	}
+	defer func() {
+		if channelClosed(ch) {
+			ch = nil
+		}
+		p.channels <- ch
+	}()
+	return fn(ch)
+}
+
+// Publish sends msg to events.<topic>.x, or hash.<topic>.x, declared as exchangeType on first
+// use, and waits for its confirm. It is safe for concurrent use, and returns
+// a *ReturnedError or *NackedError like ConfirmChannel.Publish.
+func (p *PublisherPool) Publish(ctx context.Context, exchangeType, topic string, msg PoolMessage) error {
+	if topic == "" {
+		return errors.New("topic is required")
+	}
+	routingKey, err := exchangeRoutingKey(exchangeType, topic, msg.RoutingKey)
+	if err != nil {
+		return err
+	}
+	spec := eventsExchange(topic, exchangeType)
+	exchange := spec.ExchangeName()
+
+	return p.WithChannel(ctx, func(ch ConfirmPublisher) error {
+		if err := p.declare(ch, spec); err != nil {
+			return err
+		}
+		err := ch.Publish(ctx, exchange, routingKey, msg.Publishing)
+		if err == nil || errors.Is(err, ErrUnroutable) || errors.Is(err, ErrPublishNacked) {
+			return err
+		}
+		// The exchange may have been deleted, declare it again next time
+		p.mu.Lock()
+		delete(p.declared, exchange)
+		p.mu.Unlock()
+		return fmt.Errorf("publish to %s: %w", exchange, err)
+	})
+}
+
+// declare declares the exchange unless the pool already did
+func (p *PublisherPool) declare(ch Channel, spec ExchangeSpec) error {
+	name := spec.ExchangeName()
+	p.mu.Lock()
+	kind, ok := p.declared[name]
+	p.mu.Unlock()
+	if ok && kind == spec.Type {
+		return nil
+	}
+	if err := spec.Declare(ch); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.declared[name] = spec.Type
+	p.mu.Unlock()
+	return nil
+}
+
+// Close waits for the publishes in flight and closes every channel
+func (p *PublisherPool) Close() error {
+	var errs []error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		for i := 0; i < cap(p.channels); i++ {
+			errs = append(errs, closeChannel(<-p.channels))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// channelClosed reports whether the broker or connection closed ch
+func channelClosed(ch ConfirmPublisher) bool {
+	c, ok := ch.(interface{ IsClosed() bool })
+	return ok && c.IsClosed()
+}
+
+// closeChannel closes ch unless it is already closed
+func closeChannel(ch ConfirmPublisher) error {
+	if c, ok := ch.(interface{ Close() error }); ok && !channelClosed(ch) {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// exclusiveConn opens channels that fail when two goroutines publish on
+// them at the same time
+type exclusiveConn struct {
+	*fakeBroker
+}
+
+func (c exclusiveConn) ConfirmChannel() (ConfirmPublisher, error) {
+	return &exclusiveChannel{fakeChannel: c.Channel()}, nil
+}
+
+type exclusiveChannel struct {
+	*fakeChannel
+	inUse atomic.Bool
+}
+
+func (c *exclusiveChannel) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if !c.inUse.CompareAndSwap(false, true) {
+		return errors.New("channel used by two publishers at once")
+	}
+	defer c.inUse.Store(false)
+	time.Sleep(time.Millisecond) // waiting for the confirm
+	return c.fakeChannel.Publish(ctx, exchange, routingKey, msg)
+}
+
+// stalledConn opens channels whose confirms never arrive
+type stalledConn struct {
+	*fakeBroker
+}
+
+func (c stalledConn) ConfirmChannel() (ConfirmPublisher, error) {
+	return stalledChannel{c.Channel()}, nil
+}
+
+type stalledChannel struct {
+	*fakeChannel
+}
+
+func (c stalledChannel) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPublisherPoolConcurrentPublish(t *testing.T) {
+	b := newFakeBroker()
+	if err := DirectTopology("orders").Apply(b.Channel()); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPublisherPool(exclusiveConn{b}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	const goroutines, each = 20, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*each)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				msg := PoolMessage{Publishing: amqp.Publishing{Body: []byte(fmt.Sprintf(`{"i":%d}`, i))}}
+				if err := pool.Publish(context.Background(), "direct", "orders", msg); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := b.Len(util.GetQueueName("orders", "main", util.NormalQueue)); n != goroutines*each {
+		t.Errorf("main queue has %d messages, want %d", n, goroutines*each)
+	}
+
+	err = pool.Publish(context.Background(), "direct", "orders", PoolMessage{RoutingKey: "nowhere"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("err = %v, want ErrUnroutable", err)
+	}
+}
+
+func TestPublisherPoolWaitsWhileBlocked(t *testing.T) {
+	b := newFakeBroker()
+	if err := DirectTopology("orders").Apply(b.Channel()); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPublisherPool(b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+
+	b.SetBlocked(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pool.Publish(ctx, "direct", "orders", PoolMessage{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v while blocked, want the context deadline", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- pool.Publish(context.Background(), "direct", "orders", PoolMessage{})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if n := b.Len(mainQueue); n != 0 {
+		t.Fatalf("%d messages published while blocked", n)
+	}
+	b.SetBlocked(false)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := b.Len(mainQueue); n != 1 {
+		t.Errorf("main queue has %d messages, want 1", n)
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Publish(context.Background(), "direct", "orders", PoolMessage{}); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("err = %v after Close, want ErrPoolClosed", err)
+	}
+}
+
+func TestPublisherPoolCancelUnblocksConfirm(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish func(ctx context.Context, payload *PublisherPayload) error
+	}{
+		{"direct", Publisher},
+		{"topic", PublisherTopic},
+		{"fanout", PublisherFanout},
+		{"headers", PublisherHeaders},
+		{"partitioned", PublisherPartitioned},
+		{"delayed", func(ctx context.Context, payload *PublisherPayload) error {
+			payload.Delay, payload.DelayMode = time.Minute, DelayTTL
+			return PublisherDelayed(ctx, payload, "direct")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewPublisherPool(stalledConn{newFakeBroker()}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- pool.WithChannel(ctx, func(ch ConfirmPublisher) error {
+					payload := &PublisherPayload{Channel: ch, Topic: "orders", RoutingKey: "order-42", Message: "{}"}
+					return tt.publish(ctx, payload)
+				})
+			}()
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("err = %v, want context.Canceled", err)
+				}
+			case <-time.After(time.Second):
+				// Close would wait for the stuck publish
+				t.Fatal("publish still waits for its confirm after ctx was canceled")
+			}
+			pool.Close()
+		})
+	}
+}
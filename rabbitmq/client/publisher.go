@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 
@@ -10,117 +12,249 @@ import (
 )
 
 type PublisherPayload struct {
-	Channel *amqp.Channel
-	Topic   string
-	Message string
+	Channel    ConfirmPublisher // used by one publisher at a time, e.g. from PublisherPool.WithChannel
+	Topic      string
+	RoutingKey string // defaults to the main queue name; ignored by fanout
+	Message    string
+	Headers    map[string]string // message headers, matched by headers exchange bindings
+	Envelope   Envelope          // message properties; MessageID and Timestamp are generated when empty
+	Schemas    *SchemaRegistry   // when set, the message must match its type's schema
+	Delay      time.Duration     // how long PublisherDelayed holds the message
+	DelayMode  DelayMode         // how the delay is held, plugin (default) or ttl
+}
+
+// routingKey returns the key to publish with
+func (p *PublisherPayload) routingKey() string {
+	if p.RoutingKey != "" {
+		return p.RoutingKey
+	}
+	return util.GetQueueName(p.Topic, "main", util.NormalQueue)
+}
+
+// eventsExchange is the exchange messages of exchangeType are published to,
+// events.<topic>.x. A consistent-hash exchange has its own hash.<topic>.x, so
+// a topic can be partitioned while events.<topic>.x keeps its type.
+func eventsExchange(topic, exchangeType string) ExchangeSpec {
+	kind := util.Events
+	if exchangeType == ConsistentHashExchange {
+		kind = util.Hash
+	}
+	return ExchangeSpec{
+		ExchangeRef: ExchangeRef{Service: topic, Kind: kind},
+		Type:        exchangeType,
+		Durable:     true,
+	}
+}
+
+// exchangeRoutingKey returns the key a message for the events exchange of
+// exchangeType is published with
+func exchangeRoutingKey(exchangeType, topic, routingKey string) (string, error) {
+	switch exchangeType {
+	case "fanout", "headers":
+		return "", nil
+	case ConsistentHashExchange:
+		if routingKey == "" {
+			return "", errors.New("publishing to a consistent-hash exchange needs a routing key to partition by")
+		}
+		return routingKey, nil
+	case "direct", "topic":
+	default:
+		return "", fmt.Errorf("invalid exchange type %q", exchangeType)
+	}
+	if routingKey == "" {
+		routingKey = util.GetQueueName(topic, "main", util.NormalQueue)
+	}
+	if exchangeType == "topic" {
+		return routingKey, util.ValidateRoutingKey(routingKey)
+	}
+	return routingKey, nil
+}
+
+// publishing validates the message and builds it with its envelope
+func (p *PublisherPayload) publishing() (amqp.Publishing, error) {
+	body := []byte(p.Message)
+	if p.Schemas != nil {
+		if err := p.Schemas.Validate(p.Envelope.Type, p.Envelope.Version, body); err != nil {
+			return amqp.Publishing{}, fmt.Errorf("invalid message: %w", err)
+		}
+	}
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         body,
+		DeliveryMode: amqp.Persistent, // 0: transient, 1: persistent
+	}
+	if len(p.Headers) > 0 {
+		msg.Headers = amqp.Table{}
+		for k, v := range p.Headers {
+			msg.Headers[k] = v
+		}
+	}
+	p.Envelope.Apply(&msg)
+	return msg, nil
 }
 
 // Method 1: direct exchange
-func Publisher(payload *PublisherPayload) {
-	exchange := util.GetExchangeName(payload.Topic, util.Events)
-	err := payload.Channel.ExchangeDeclare(
-		exchange, // name
-		"direct", // type
-		true,    // durable
-		false,   // auto-deleted
-		false,   // internal
-		false,   // no-wait
-		nil,     // arguments
-	)
+func Publisher(ctx context.Context, payload *PublisherPayload) error {
+	spec := ExchangeSpec{
+		ExchangeRef: ExchangeRef{Service: payload.Topic, Kind: util.Events},
+		Type:        "direct",
+		Durable:     true,
+	}
+	if err := spec.Declare(payload.Channel); err != nil {
+		return err
+	}
+	exchange := spec.ExchangeName()
+
+	msg, err := payload.publishing()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// Publish the message
-	routingKey := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
-	err = payload.Channel.PublishWithContext(
-		context.Background(),
-		exchange, // exchange
+	// Publish the message and wait for the broker to confirm it
+	routingKey := payload.routingKey()
+	err = payload.Channel.Publish(
+		ctx,
+		exchange,   // exchange
 		routingKey, // routing key
-		false,         // mandatory
-		false,         // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         []byte(payload.Message),
-			DeliveryMode: amqp.Persistent, // 0: transient, 1: persistent
-		},
+		msg,
 	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("publish to %s: %w", exchange, err)
 	}
 
 	fmt.Printf("Published message to topic: %s | message: %s\n", payload.Topic, payload.Message)
+	return nil
 }
 
 // Method 2: topic exchange
-func PublisherTopic(payload *PublisherPayload) {
-	exchange := util.GetExchangeName(payload.Topic, util.Events)
-	err := payload.Channel.ExchangeDeclare(
-		exchange, // name
-		"topic",  // type
-		true,     // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // no-wait
-		nil,      // arguments
-	)
+func PublisherTopic(ctx context.Context, payload *PublisherPayload) error {
+	spec := ExchangeSpec{
+		ExchangeRef: ExchangeRef{Service: payload.Topic, Kind: util.Events},
+		Type:        "topic",
+		Durable:     true,
+	}
+	if err := spec.Declare(payload.Channel); err != nil {
+		return err
+	}
+	exchange := spec.ExchangeName()
+
+	msg, err := payload.publishing()
 	if err != nil {
-		panic(err)
-	}
-
-	// Publish the message
-	routingKey := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
-	err = payload.Channel.PublishWithContext(
-		context.Background(),
-		exchange,    // exchange
-		routingKey,  // routing key
-		false,         // mandatory
-		false,         // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         []byte(payload.Message),
-			DeliveryMode: amqp.Persistent, // 0: transient, 1: persistent
-		},
+		return err
+	}
+
+	// Publish the message and wait for the broker to confirm it
+	routingKey := payload.routingKey()
+	if err := util.ValidateRoutingKey(routingKey); err != nil {
+		return err
+	}
+	err = payload.Channel.Publish(
+		ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		msg,
 	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("publish to %s: %w", exchange, err)
 	}
 
-	fmt.Printf("Published message to topic exchange: %s | message: %s\n", payload.Topic, payload.Message)
+	fmt.Printf("Published message to topic exchange: %s | routing key: %s | message: %s\n", payload.Topic, routingKey, payload.Message)
+	return nil
 }
 
 // Method 3: fanout exchange
-func PublisherFanout(payload *PublisherPayload) {
-	exchange := util.GetExchangeName(payload.Topic, util.Events)
-	err := payload.Channel.ExchangeDeclare(
-		exchange, // name
-		"fanout", // type
-		true,          // durable
-		false,         // auto-deleted
-		false,         // internal
-		false,         // no-wait
-		nil,           // arguments
-	)
+func PublisherFanout(ctx context.Context, payload *PublisherPayload) error {
+	spec := ExchangeSpec{
+		ExchangeRef: ExchangeRef{Service: payload.Topic, Kind: util.Events},
+		Type:        "fanout",
+		Durable:     true,
+	}
+	if err := spec.Declare(payload.Channel); err != nil {
+		return err
+	}
+	exchange := spec.ExchangeName()
+
+	msg, err := payload.publishing()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	// Publish the message
-	err = payload.Channel.PublishWithContext(
-		context.Background(),
+	// Publish the message and wait for the broker to confirm it
+	err = payload.Channel.Publish(
+		ctx,
 		exchange, // exchange
 		"",       // routing key (empty for fanout)
-		false,         // mandatory
-		false,         // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         []byte(payload.Message),
-			DeliveryMode: amqp.Persistent, // 0: transient, 1: persistent
-		},
+		msg,
 	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("publish to %s: %w", exchange, err)
 	}
 
 	fmt.Printf("Published message to fanout exchange: %s | message: %s\n", payload.Topic, payload.Message)
+	return nil
+}
+
+// Method 4: headers exchange
+func PublisherHeaders(ctx context.Context, payload *PublisherPayload) error {
+	spec := ExchangeSpec{
+		ExchangeRef: ExchangeRef{Service: payload.Topic, Kind: util.Events},
+		Type:        "headers",
+		Durable:     true,
+	}
+	if err := spec.Declare(payload.Channel); err != nil {
+		return err
+	}
+	exchange := spec.ExchangeName()
+
+	msg, err := payload.publishing()
+	if err != nil {
+		return err
+	}
+
+	// Publish the message and wait for the broker to confirm it
+	err = payload.Channel.Publish(
+		ctx,
+		exchange, // exchange
+		"",       // routing key (ignored by headers exchanges)
+		msg,
+	)
+	if err != nil {
+		return fmt.Errorf("publish to %s: %w", exchange, err)
+	}
+
+	fmt.Printf("Published message to headers exchange: %s | headers: %v | message: %s\n", payload.Topic, payload.Headers, payload.Message)
+	return nil
+}
+
+// Method 5: consistent-hash exchange hash.<topic>.x. The routing key is the
+// partition key, e.g. the order ID, so every message of one key goes to the
+// same sub-queue.
+func PublisherPartitioned(ctx context.Context, payload *PublisherPayload) error {
+	if payload.RoutingKey == "" {
+		return errors.New("publishing to a consistent-hash exchange needs a routing key to partition by")
+	}
+	spec := eventsExchange(payload.Topic, ConsistentHashExchange)
+	if err := spec.Declare(payload.Channel); err != nil {
+		return err
+	}
+	exchange := spec.ExchangeName()
+
+	msg, err := payload.publishing()
+	if err != nil {
+		return err
+	}
+
+	// Publish the message and wait for the broker to confirm it
+	err = payload.Channel.Publish(
+		ctx,
+		exchange,           // exchange
+		payload.RoutingKey, // routing key (hashed to pick the partition)
+		msg,
+	)
+	if err != nil {
+		return fmt.Errorf("publish to %s: %w", exchange, err)
+	}
+
+	fmt.Printf("Published message to consistent-hash exchange: %s | partition key: %s | message: %s\n", payload.Topic, payload.RoutingKey, payload.Message)
+	return nil
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// bindQueues declares an exchange of kind for topic and binds a queue per
+// pattern, named q.<topic>.<purpose>
+func bindQueues(t *testing.T, ch Channel, topic, kind string, patterns map[string]string) {
+	t.Helper()
+	exchange := ExchangeRef{Service: topic, Kind: util.Events}
+	topology := &Topology{Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: kind, Durable: true}}}
+	for purpose, pattern := range patterns {
+		queue := QueueRef{Service: topic, Purpose: purpose, Kind: util.NormalQueue}
+		topology.Queues = append(topology.Queues, QueueSpec{QueueRef: queue, Durable: true})
+		topology.Bindings = append(topology.Bindings, BindingSpec{Exchange: exchange, Queue: queue, RoutingKey: pattern})
+	}
+	if err := topology.Apply(ch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublisherUnroutable(t *testing.T) {
+	b := newFakeBroker()
+	err := Publisher(context.Background(), &PublisherPayload{Channel: b.Channel(), Topic: "orders", Message: "{}"})
+	var returned *ReturnedError
+	if !errors.Is(err, ErrUnroutable) || !errors.As(err, &returned) {
+		t.Fatalf("err = %v, want a returned message", err)
+	}
+	if returned.RoutingKey != "q.orders.main" {
+		t.Errorf("routing key = %q, want q.orders.main", returned.RoutingKey)
+	}
+}
+
+func TestPublisherTopicRouting(t *testing.T) {
+	b := newFakeBroker()
+	ch := b.Channel()
+	bindQueues(t, ch, "orders", "topic", map[string]string{
+		"created": "order.*.created",
+		"all":     "order.#",
+		"eu":      "order.eu.*",
+	})
+
+	tests := []struct {
+		routingKey string
+		want       map[string]int // purpose -> messages received
+	}{
+		{"order.eu.created", map[string]int{"created": 1, "all": 1, "eu": 1}},
+		{"order.us.created", map[string]int{"created": 1, "all": 1}},
+		{"order.eu.cancelled", map[string]int{"all": 1, "eu": 1}},
+		{"order", map[string]int{"all": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.routingKey, func(t *testing.T) {
+			if err := PublisherTopic(context.Background(), &PublisherPayload{Channel: ch, Topic: "orders", RoutingKey: tt.routingKey, Message: "{}"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, purpose := range []string{"created", "all", "eu"} {
+				queue := util.GetQueueName("orders", purpose, util.NormalQueue)
+				if n := b.Len(queue); n != tt.want[purpose] {
+					t.Errorf("%s has %d messages, want %d", queue, n, tt.want[purpose])
+				}
+				for {
+					d, ok := b.Get(queue)
+					if !ok {
+						break
+					}
+					_ = d.Ack(false)
+				}
+			}
+		})
+	}
+
+	err := PublisherTopic(context.Background(), &PublisherPayload{Channel: ch, Topic: "orders", RoutingKey: "order.*.created", Message: "{}"})
+	if err == nil {
+		t.Error("publishing with a wildcard routing key succeeded")
+	}
+}
+
+func TestPublisherFanoutReachesEveryQueue(t *testing.T) {
+	b := newFakeBroker()
+	ch := b.Channel()
+	bindQueues(t, ch, "audit", "fanout", map[string]string{"a": "", "b": "ignored"})
+
+	if err := PublisherFanout(context.Background(), &PublisherPayload{Channel: ch, Topic: "audit", Message: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, purpose := range []string{"a", "b"} {
+		if n := b.Len(util.GetQueueName("audit", purpose, util.NormalQueue)); n != 1 {
+			t.Errorf("queue %s has %d messages, want 1", purpose, n)
+		}
+	}
+}
+
+func TestPublisherExchangeTypeMismatch(t *testing.T) {
+	b := newFakeBroker()
+	ch := b.Channel()
+	bindQueues(t, ch, "orders", "topic", map[string]string{"main": "q.orders.main"})
+
+	if err := Publisher(context.Background(), &PublisherPayload{Channel: ch, Topic: "orders", Message: "{}"}); err == nil {
+		t.Error("publishing to a topic exchange as direct succeeded")
+	}
+}
+
+func TestPublisherRejectsInvalidMessage(t *testing.T) {
+	schemas, err := LoadSchemaRegistry("schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newFakeBroker()
+	ch := b.Channel()
+	if err := DirectTopology("orders").Apply(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Publisher(context.Background(), &PublisherPayload{
+		Channel:  ch,
+		Topic:    "orders",
+		Message:  `{"id":"not a number"}`,
+		Envelope: NewEnvelope("checkout", "order.created", "1"),
+		Schemas:  schemas,
+	})
+	if !errors.Is(err, ErrValidation) {
+		t.Fatalf("err = %v, want a validation error", err)
+	}
+	if n := b.Len("q.orders.main"); n != 0 {
+		t.Errorf("invalid message was published")
+	}
+}
+
+func TestSchemaRegistryValidate(t *testing.T) {
+	schemas, err := LoadSchemaRegistry("schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"valid", `{"id":1,"amount":9.5}`, nil},
+		{"trailing whitespace", "{\"id\":1,\"amount\":9.5}\n", nil},
+		{"schema violation", `{"id":0,"amount":9.5}`, ErrValidation},
+		{"malformed", `{"id":1,`, ErrInvalidPayload},
+		{"trailing garbage", `{"id":1,"amount":9.5}garbage`, ErrInvalidPayload},
+		{"concatenated values", `{"id":1,"amount":9.5}{"id":2,"amount":1}`, ErrInvalidPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schemas.Validate("order.created", "1", []byte(tt.body))
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisherHeadersRouting(t *testing.T) {
+	b := newFakeBroker()
+	ch := b.Channel()
+	exchange := ExchangeRef{Service: "orders", Kind: util.Events}
+	topology := &Topology{Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: "headers", Durable: true}}}
+	bindings := map[string]BindingSpec{
+		"eu-acme":    {Headers: map[string]interface{}{"tenant": "acme", "region": "eu"}},
+		"acme-or-eu": {Headers: map[string]interface{}{"tenant": "acme", "region": "eu"}, Match: util.MatchAny},
+	}
+	for purpose, binding := range bindings {
+		queue := QueueRef{Service: "orders", Purpose: purpose, Kind: util.NormalQueue}
+		binding.Exchange, binding.Queue = exchange, queue
+		topology.Queues = append(topology.Queues, QueueSpec{QueueRef: queue, Durable: true})
+		topology.Bindings = append(topology.Bindings, binding)
+	}
+	if err := topology.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := topology.Apply(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    map[string]int // purpose -> messages received
+	}{
+		{"all headers", map[string]string{"tenant": "acme", "region": "eu", "env": "prod"}, map[string]int{"eu-acme": 1, "acme-or-eu": 1}},
+		{"one header", map[string]string{"tenant": "acme", "region": "us"}, map[string]int{"acme-or-eu": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := &PublisherPayload{Channel: ch, Topic: "orders", Message: "{}", Headers: tt.headers, Envelope: NewEnvelope("checkout", "", "1")}
+			if err := PublisherHeaders(context.Background(), payload); err != nil {
+				t.Fatal(err)
+			}
+			for purpose := range bindings {
+				queue := util.GetQueueName("orders", purpose, util.NormalQueue)
+				if n := b.Len(queue); n != tt.want[purpose] {
+					t.Errorf("%s has %d messages, want %d", queue, n, tt.want[purpose])
+				}
+				for {
+					d, ok := b.Get(queue)
+					if !ok {
+						break
+					}
+					_ = d.Ack(false)
+				}
+			}
+		})
+	}
+
+	err := PublisherHeaders(context.Background(), &PublisherPayload{Channel: ch, Topic: "orders", Message: "{}", Headers: map[string]string{"tenant": "globex"}})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Errorf("err = %v, want ErrUnroutable", err)
+	}
+}
+
+func TestPublisherQueueFull(t *testing.T) {
+	tests := []struct {
+		overflow util.Overflow
+		wantErr  bool
+		wantDLQ  int // messages dead-lettered with reason maxlen
+	}{
+		{overflow: util.DropHead, wantDLQ: 1},
+		{overflow: util.RejectPublish, wantErr: true},
+		{overflow: util.RejectPublishDLX, wantErr: true, wantDLQ: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.overflow), func(t *testing.T) {
+			b := newFakeBroker()
+			ch := b.Channel()
+			mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+			topology := DirectTopology("orders").WithLimits(mainQueue, QueueLimits{MaxLength: 1, Overflow: tt.overflow})
+			if err := topology.Apply(ch); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, body := range []string{"first", "second"} {
+				err := Publisher(context.Background(), &PublisherPayload{Channel: ch, Topic: "orders", Message: body})
+				if i == 0 || !tt.wantErr {
+					if err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				var nacked *NackedError
+				if !errors.Is(err, ErrPublishNacked) || !errors.As(err, &nacked) || nacked.RoutingKey != mainQueue {
+					t.Fatalf("err = %v, want a nack from %s", err, mainQueue)
+				}
+			}
+
+			if n := b.Len(mainQueue); n != 1 {
+				t.Errorf("%s has %d messages, want 1", mainQueue, n)
+			}
+			dlq := util.GetQueueName("orders", "main", util.DLQ)
+			if n := b.Len(dlq); n != tt.wantDLQ {
+				t.Fatalf("%s has %d messages, want %d", dlq, n, tt.wantDLQ)
+			}
+			if tt.wantDLQ > 0 {
+				d, _ := b.Get(dlq)
+				if deaths := decodeXDeath(d.Headers); len(deaths) == 0 || deaths[0].Reason != "maxlen" {
+					t.Errorf("x-death = %v, want reason maxlen", d.Headers["x-death"])
+				}
+			}
+		})
+	}
+}
+
+func TestPublisherDelayed(t *testing.T) {
+	// The modes share one broker, so the second one is a switch of modes
+	b := newFakeBroker()
+	ch := b.Channel()
+	bindQueues(t, ch, "reminders", "topic", map[string]string{"due": "reminder.#"})
+	queue := util.GetQueueName("reminders", "due", util.NormalQueue)
+
+	for _, mode := range []DelayMode{DelayPlugin, DelayTTL, DelayPlugin} {
+		t.Run(string(mode), func(t *testing.T) {
+			payload := &PublisherPayload{
+				Channel:    ch,
+				Topic:      "reminders",
+				RoutingKey: "reminder.invoice",
+				Message:    "{}",
+				Delay:      5 * time.Minute,
+				DelayMode:  mode,
+			}
+			if err := PublisherDelayed(context.Background(), payload, "topic"); err != nil {
+				t.Fatal(err)
+			}
+
+			b.Advance(5*time.Minute - time.Second)
+			if n := b.Len(queue); n != 0 {
+				t.Fatalf("%s has %d messages before the delay passed", queue, n)
+			}
+			b.Advance(time.Second)
+			d, ok := b.Get(queue)
+			if !ok {
+				t.Fatalf("%s has no message after the delay passed", queue)
+			}
+			if d.RoutingKey != "reminder.invoice" || getRetryCount(d) != 0 {
+				t.Errorf("received routing key %q with retry count %d", d.RoutingKey, getRetryCount(d))
+			}
+		})
+	}
+}
+
+func TestDelayBucket(t *testing.T) {
+	tests := []struct {
+		delay, want time.Duration
+	}{
+		{1500 * time.Millisecond, 2 * time.Second},
+		{time.Minute, time.Minute},
+		{61 * time.Second, 2 * time.Minute},
+		{2*time.Hour + 30*time.Second, 2*time.Hour + time.Minute},
+	}
+	for _, tt := range tests {
+		if got := DelayBucket(tt.delay); got != tt.want {
+			t.Errorf("DelayBucket(%s) = %s, want %s", tt.delay, got, tt.want)
+		}
+	}
+
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if got, err := ParseDelay(0, "2024-05-01T12:30:00Z", now); err != nil || got != 150*time.Minute {
+		t.Errorf("ParseDelay() = %s, %v, want 2h30m", got, err)
+	}
+	for _, at := range []string{"2024-05-01T09:00:00Z", "12:30"} {
+		if _, err := ParseDelay(0, at, now); err == nil {
+			t.Errorf("ParseDelay(%q) succeeded, want error", at)
+		}
+	}
+	if _, err := ParseDelay(time.Minute, "2024-05-01T12:30:00Z", now); err == nil {
+		t.Error("ParseDelay() with a delay and a delivery time succeeded")
+	}
+}
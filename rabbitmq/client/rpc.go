@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// DirectReplyTo is the pseudo-queue for RabbitMQ direct reply-to. Replies are
+// sent straight to the consuming channel without declaring a reply queue.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError carries the handler error in a reply
+const HeaderRPCError = "x-rpc-error"
+
+// ErrCallTimeout is returned when no reply arrives within the call timeout
+var ErrCallTimeout = errors.New("rpc call timed out")
+
+// RemoteError is a handler error returned by the server in a reply
+type RemoteError struct {
+	Service string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Service, e.Message)
+}
+
+// CommandHandler handles one command and returns the reply body
+type CommandHandler interface {
+	HandleCommand(ctx context.Context, d amqp.Delivery) ([]byte, error)
+}
+
+// CommandHandlerFunc adapts a plain function to the CommandHandler interface
+type CommandHandlerFunc func(ctx context.Context, d amqp.Delivery) ([]byte, error)
+
+func (f CommandHandlerFunc) HandleCommand(ctx context.Context, d amqp.Delivery) ([]byte, error) {
+	return f(ctx, d)
+}
+
+// EchoCommandHandler is used for services without a registered command handler
+var EchoCommandHandler = CommandHandlerFunc(func(ctx context.Context, d amqp.Delivery) ([]byte, error) {
+	log.Printf("command: %v", string(d.Body))
+	return d.Body, nil
+})
+
+var (
+	commandHandlersMu sync.RWMutex
+	commandHandlers   = map[string]CommandHandler{}
+)
+
+// RegisterCommandHandler sets the handler used by every server of service
+func RegisterCommandHandler(service string, h CommandHandler) {
+	if service == "" {
+		panic("service is required")
+	}
+	if h == nil {
+		panic("handler is required")
+	}
+	commandHandlersMu.Lock()
+	defer commandHandlersMu.Unlock()
+	commandHandlers[service] = h
+}
+
+// CommandHandlerFor returns the command handler registered for service, or EchoCommandHandler
+func CommandHandlerFor(service string) CommandHandler {
+	commandHandlersMu.RLock()
+	defer commandHandlersMu.RUnlock()
+	if h, ok := commandHandlers[service]; ok {
+		return h
+	}
+	return EchoCommandHandler
+}
+
+// CommandTopology is the command exchange and the queue shared by the servers
+// of a service. Commands are routed with the queue name as the routing key.
+//
+// cmd.<service>.x ──► q.<service>.commands
+func CommandTopology(service string) *Topology {
+	exchange := ExchangeRef{Service: service, Kind: util.Commands}
+	queue := QueueRef{Service: service, Purpose: "commands", Kind: util.NormalQueue}
+
+	return &Topology{
+		Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: "direct", Durable: true}},
+		Queues:    []QueueSpec{{QueueRef: queue, Durable: true}},
+		Bindings:  []BindingSpec{{Exchange: exchange, Queue: queue}},
+	}
+}
+
+// RPCClient sends commands and waits for their replies on direct reply-to.
+// It is safe for concurrent use; replies are matched by CorrelationId.
+type RPCClient struct {
+	Timeout time.Duration // per call, used when ctx has no earlier deadline
+
+	ch      *ConfirmChannel
+	mu      sync.Mutex
+	pending map[string]chan amqp.Delivery // keyed by CorrelationId
+	done    chan struct{}                 // closed when the channel is closed
+}
+
+// NewRPCClient opens a channel for calls. The reply consumer has to be
+// started before the first command is published on the same channel.
+func NewRPCClient(conn *Connection, timeout time.Duration) (*RPCClient, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	confirmCh, err := NewConfirmChannel(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	replies, err := ch.Consume(
+		DirectReplyTo, // queue
+		"",            // consumer
+		true,          // auto-ack, required by direct reply-to
+		false,         // exclusive
+		false,         // no-local
+		false,         // no-wait
+		nil,           // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("consume %s: %w", DirectReplyTo, err)
+	}
+
+	c := &RPCClient{
+		Timeout: timeout,
+		ch:      confirmCh,
+		pending: map[string]chan amqp.Delivery{},
+		done:    make(chan struct{}),
+	}
+	go c.dispatch(replies)
+	return c, nil
+}
+
+// dispatch hands each reply to the call waiting for it
+func (c *RPCClient) dispatch(replies <-chan amqp.Delivery) {
+	defer close(c.done)
+	for d := range replies {
+		c.mu.Lock()
+		reply, ok := c.pending[d.CorrelationId]
+		delete(c.pending, d.CorrelationId)
+		c.mu.Unlock()
+		if !ok {
+			log.Printf("Dropping reply for unknown or timed out call %q", d.CorrelationId)
+			continue
+		}
+		reply <- d
+	}
+}
+
+// Call publishes body to cmd.<service>.x and returns the reply body. It fails
+// with ErrUnroutable when no server has declared the service's command queue
+// yet, with ErrCallTimeout when the reply does not arrive in time, and with a
+// *RemoteError when the server's handler failed. The command queue outlives
+// its servers, so with no server running a call usually times out.
+func (c *RPCClient) Call(ctx context.Context, service string, body []byte) ([]byte, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	correlationID := newMessageID()
+	reply := make(chan amqp.Delivery, 1)
+	c.mu.Lock()
+	c.pending[correlationID] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, correlationID)
+		c.mu.Unlock()
+	}()
+
+	msg := amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: correlationID,
+		ReplyTo:       DirectReplyTo,
+		Body:          body,
+		DeliveryMode:  amqp.Transient, // a command is useless once its caller gave up
+	}
+	// Commands nobody picked up before the caller gives up are dropped by the broker
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10)
+	}
+
+	exchange := util.GetExchangeName(service, util.Commands)
+	routingKey := util.GetQueueName(service, "commands", util.NormalQueue)
+	if err := c.ch.Publish(ctx, exchange, routingKey, msg); err != nil {
+		return nil, fmt.Errorf("call %s: %w", service, err)
+	}
+
+	select {
+	case d := <-reply:
+		if errMsg, ok := d.Headers[HeaderRPCError].(string); ok {
+			return nil, &RemoteError{Service: service, Message: errMsg}
+		}
+		return d.Body, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("call %s: %w", service, ErrCallTimeout)
+		}
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, fmt.Errorf("call %s: %w", service, ErrChannelClosed)
+	}
+}
+
+// Close closes the client's channel
+func (c *RPCClient) Close() error {
+	return c.ch.Close()
+}
+
+// Method 6: RPC server on the command exchange
+func ServeCommands(ctx context.Context, payload *SubscriberPayload) {
+	fmt.Printf("Serving commands for: %s\n", payload.Topic)
+
+	topology := CommandTopology(payload.Topic).WithQueueType(payload.QueueType, 0)
+	queueName := topology.Queues[0].QueueName()
+	payload.limit(topology, queueName)
+
+	setup := func(ch Channel) (string, error) {
+		return queueName, topology.Apply(ch)
+	}
+
+	handler := CommandHandlerFor(payload.Topic)
+
+	log.Printf(" [*] Waiting for commands. To exit press CTRL+C")
+	if err := runWorkers(ctx, payload, "rpc", setup, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		handleCommand(ctx, handler, ch, d)
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// handleCommand runs handler and replies to the caller. Handler errors are
+// sent back in the HeaderRPCError header rather than retried, since the
+// caller is waiting. Commands without ReplyTo are handled fire-and-forget.
+func handleCommand(ctx context.Context, handler CommandHandler, ch Channel, d amqp.Delivery) {
+	body, err := handler.HandleCommand(ctx, d)
+	if d.ReplyTo == "" {
+		if err != nil {
+			log.Printf("command failed, no reply-to: %v", err)
+		}
+		d.Ack(false)
+		return
+	}
+
+	reply := amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: d.CorrelationId,
+		Body:          body,
+	}
+	if err != nil {
+		log.Printf("command failed, replying with error: %v", err)
+		spanError(ctx, err)
+		reply.Headers = amqp.Table{HeaderRPCError: err.Error()}
+		reply.Body = nil
+	}
+	reply.Headers = injectTrace(ctx, reply.Headers)
+
+	// Replies go through the default exchange with the reply-to as routing key
+	if pubErr := ch.PublishWithContext(ctx, "", d.ReplyTo, false, false, reply); pubErr != nil {
+		log.Printf("Failed to publish reply: %v; nacking for requeue", pubErr)
+		_ = d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+type RPCPayload struct {
+	Conn    *Connection
+	Topic   string
+	Message string
+	Timeout time.Duration
+}
+
+// RPCCall sends one command and prints the reply
+func RPCCall(ctx context.Context, payload *RPCPayload) error {
+	client, err := NewRPCClient(payload.Conn, payload.Timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := CommandTopology(payload.Topic).Exchanges[0].Declare(client.ch.Channel); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	reply, err := client.Call(ctx, payload.Topic, []byte(payload.Message))
+	if errors.Is(err, ErrUnroutable) || errors.Is(err, ErrCallTimeout) {
+		return fmt.Errorf("%w (is a server running? go run . -action serve -topic %s)", err, payload.Topic)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Reply from %s in %s: %s\n", payload.Topic, time.Since(start).Round(time.Millisecond), reply)
+	return nil
+}
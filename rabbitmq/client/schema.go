@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrNoSchema is returned for message types without a schema in the registry
+var ErrNoSchema = fmt.Errorf("%w: no schema for message type", ErrValidation)
+
+// SchemaError is a message body that does not match its type's schema
+type SchemaError struct {
+	Type    string
+	Version string
+	Err     error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("schema violation for %s v%s: %v", e.Type, e.Version, e.Err)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes schema violations permanent validation failures
+func (e *SchemaError) Is(target error) bool {
+	return target == ErrValidation || target == ErrPermanent
+}
+
+// versionSuffix matches the version part of <type>.v<version>.json
+var versionSuffix = regexp.MustCompile(`^(.+)\.v([0-9][0-9A-Za-z.-]*)$`)
+
+// SchemaRegistry holds the JSON Schemas of a directory, keyed by message
+// type. A file named <type>.json applies to every version of the type, and
+// <type>.v<version>.json to one version only, e.g. order.created.v2.json.
+// Schemas may $ref each other by relative path.
+type SchemaRegistry struct {
+	Dir     string
+	schemas map[string]*jsonschema.Schema // keyed by type or type@version
+}
+
+// LoadSchemaRegistry compiles every *.json file in dir
+func LoadSchemaRegistry(dir string) (*SchemaRegistry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("schema registry: %w", err)
+		}
+	}
+
+	compiler := jsonschema.NewCompiler()
+	r := &SchemaRegistry{Dir: dir, schemas: map[string]*jsonschema.Schema{}}
+	for _, path := range paths {
+		schema, err := compiler.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("schema registry: %w", err)
+		}
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+		if m := versionSuffix.FindStringSubmatch(key); m != nil {
+			key = m[1] + "@" + m[2]
+		}
+		r.schemas[key] = schema
+	}
+	return r, nil
+}
+
+// Lookup returns the schema for a type and version, preferring a
+// version-specific schema over the type's general one
+func (r *SchemaRegistry) Lookup(msgType, version string) (*jsonschema.Schema, bool) {
+	if version != "" {
+		if s, ok := r.schemas[msgType+"@"+version]; ok {
+			return s, true
+		}
+	}
+	s, ok := r.schemas[msgType]
+	return s, ok
+}
+
+// Validate checks body against the schema of its type. Every message needs a
+// type with a schema, so untyped or unknown messages are rejected as well.
+func (r *SchemaRegistry) Validate(msgType, version string, body []byte) error {
+	if msgType == "" {
+		return fmt.Errorf("%w: message has no type", ErrValidation)
+	}
+	schema, ok := r.Lookup(msgType, version)
+	if !ok {
+		return fmt.Errorf("%w %q in %s", ErrNoSchema, msgType, r.Dir)
+	}
+
+	// Numbers are decoded as json.Number so large integers keep their precision
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	// The body must hold exactly one JSON value
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return fmt.Errorf("%w: unexpected data after the JSON value", ErrInvalidPayload)
+	}
+	if err := schema.Validate(doc); err != nil {
+		var ve *jsonschema.ValidationError
+		if errors.As(err, &ve) {
+			// The leaf cause names the field and the failed keyword
+			leaf := ve
+			for len(leaf.Causes) > 0 {
+				leaf = leaf.Causes[0]
+			}
+			err = fmt.Errorf("%s: %s", instancePath(leaf.InstanceLocation), leaf.Message)
+		}
+		return &SchemaError{Type: msgType, Version: version, Err: err}
+	}
+	return nil
+}
+
+func instancePath(loc string) string {
+	if loc == "" {
+		return "/"
+	}
+	return loc
+}
+
+// ValidatingHandler checks each delivery against the registry before calling
+// next. Schema violations are permanent errors, so they skip retries and are
+// moved to the DLQ with the violation as the reason.
+func ValidatingHandler(r *SchemaRegistry, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		env := EnvelopeOf(d)
+		if err := r.Validate(env.Type, env.Version, d.Body); err != nil {
+			return err
+		}
+		return next.Handle(ctx, d)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// StreamTopology binds a stream to the events exchange with the main queue
+// routing key, so it keeps a replayable log of everything Publisher sends.
+//
+// events.<service>.x ──► q.<service>.<purpose> (x-queue-type: stream)
+func StreamTopology(service, purpose string) *Topology {
+	mainExchange := ExchangeRef{Service: service, Kind: util.Events}
+	stream := QueueRef{Service: service, Purpose: purpose, Kind: util.NormalQueue}
+	mainQueue := QueueRef{Service: service, Kind: util.NormalQueue}
+
+	return &Topology{
+		Exchanges: []ExchangeSpec{
+			{ExchangeRef: mainExchange, Type: "direct", Durable: true},
+		},
+		Queues: []QueueSpec{
+			{QueueRef: stream, Type: util.StreamQueue, Durable: true},
+		},
+		Bindings: []BindingSpec{
+			{Exchange: mainExchange, Queue: stream, RoutingKey: mainQueue.QueueName()},
+		},
+	}
+}
+
+// ParseStreamOffset converts the -offset flag into an x-stream-offset value:
+//
+//	first, last, next      named positions in the stream
+//	42                     an absolute offset
+//	2024-05-01T10:00:00Z   the first chunk at or after an RFC 3339 timestamp
+//	15m                    the first chunk at or after 15 minutes ago
+func ParseStreamOffset(s string) (interface{}, error) {
+	switch s {
+	case "", "next":
+		return "next", nil
+	case "first", "last":
+		return s, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 {
+			return nil, fmt.Errorf("stream offset %d must not be negative", n)
+		}
+		return n, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Now().Add(-d), nil
+	}
+	return nil, fmt.Errorf("invalid stream offset %q, must be first, last, next, an offset, an RFC 3339 timestamp or a duration", s)
+}
+
+// Method 5: stream consumer
+//
+// Streams are not consumed destructively: every consumer reads the whole log
+// from its own offset, and acks only grant the consumer more credit. After a
+// reconnect the consumer resumes after the last offset it handled, instead of
+// starting again from payload.StreamOffset.
+func SubscriberStream(ctx context.Context, payload *SubscriberPayload) {
+	purpose := payload.Purpose
+	if purpose == "" {
+		purpose = "main"
+	}
+	fmt.Printf("Subscribing to stream: %s\n", util.GetQueueName(payload.Topic, purpose, util.NormalQueue))
+
+	offset, err := ParseStreamOffset(payload.StreamOffset)
+	if err != nil {
+		panic(err)
+	}
+
+	topology := StreamTopology(payload.Topic, purpose)
+	streamName := topology.Queues[0].QueueName()
+	payload.limit(topology, streamName)
+
+	// Offset of the last handled delivery, -1 until the first one
+	var last atomic.Int64
+	last.Store(-1)
+
+	args := amqp.Table{}
+	setup := func(ch Channel) (string, error) {
+		// Setup runs before every ch.Consume, on the same goroutine
+		args["x-stream-offset"] = offset
+		if n := last.Load(); n >= 0 {
+			args["x-stream-offset"] = n + 1
+		}
+		log.Printf("Reading %s from offset %v", streamName, args["x-stream-offset"])
+		return streamName, topology.Apply(ch)
+	}
+
+	handler := payload.handler()
+
+	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	if err := payload.Conn.Consume(ctx, ConsumeOptions{
+		Tag:             "stream",
+		Prefetch:        payload.Prefetch,
+		Args:            args,
+		ShutdownTimeout: payload.ShutdownTimeout,
+		Setup:           setup,
+	}, tracedDelivery(meteredDelivery(payload.Topic, func() string { return streamName }, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		// Streams cannot requeue or dead-letter, so failures are only logged
+		if err := handler.Handle(ctx, d); err != nil {
+			spanError(ctx, err)
+			log.Printf("handler failed at offset %v, skipping message: %v", d.Headers["x-stream-offset"], err)
+		}
+		if n, ok := d.Headers["x-stream-offset"].(int64); ok {
+			last.Store(n)
+		}
+		d.Ack(false)
+	}))); err != nil {
+		panic(err)
+	}
+}
@@ -2,80 +2,228 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"math"
+	"strings"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
 )
 
-func ProcessWithRetry(service string, d amqp.Delivery, ch *amqp.Channel) {
-	maxRetries := 3
+// DefaultRetryBackoff is the delay before each retry, matching the
+// (attempt)^2 seconds schedule
+var DefaultRetryBackoff = []time.Duration{1 * time.Second, 4 * time.Second, 9 * time.Second}
+
+// Header counting how many times ProcessWithRetry has retried a message
+const HeaderRetryCount = "x-retry-count"
+
+// Main Queue -> Retry Exchange -> Retry Tier Queue (TTL) -> Main Exchange,
+// and Main Queue -> DLX -> DLQ after len(backoff) retries.
+//
+// Each delay gets its own tier queue with a queue-level x-message-ttl. The
+// broker only expires messages at the head of a queue, so sharing one queue
+// between delays would hold short delays up behind long ones.
+func RetryTopology(service string, backoff []time.Duration) *Topology {
+	retryExchange := ExchangeRef{Service: service, Kind: util.Retry}
+	mainQueue := QueueRef{Service: service, Kind: util.NormalQueue}
+	mainExchange := ExchangeRef{Service: service, Kind: util.Events}
+
+	topology := &Topology{
+		Exchanges: []ExchangeSpec{
+			{ExchangeRef: retryExchange, Type: "direct", Durable: true},
+		},
+	}
+	seen := map[time.Duration]bool{}
+	for _, delay := range backoff {
+		if seen[delay] {
+			continue
+		}
+		seen[delay] = true
+
+		// Expired messages are dead-lettered back to the main queue
+		tier := QueueRef{Name: retryTierQueueName(service, delay)}
+		topology.Queues = append(topology.Queues, QueueSpec{
+			QueueRef:    tier,
+			Durable:     true,
+			QueueLimits: QueueLimits{MessageTTL: delay.Milliseconds()},
+			DeadLetter:  &DeadLetterSpec{Exchange: mainExchange, Queue: &mainQueue},
+		})
+		topology.Bindings = append(topology.Bindings, BindingSpec{Exchange: retryExchange, Queue: tier})
+	}
+	return DirectTopology(service).Merge(topology)
+}
+
+// retryTierQueueName names the retry queue for a delay, e.g. q.orders.main.retry.4s.
+// It is also the routing key on the retry exchange.
+func retryTierQueueName(service string, delay time.Duration) string {
+	return util.GetQueueName(service, "main", util.RetryQueue, util.FormatDelay(delay))
+}
+
+// ParseRetryBackoff parses a comma-separated list of delays, e.g. "1s,4s,9s".
+// Delays must be whole milliseconds, the unit of x-message-ttl.
+func ParseRetryBackoff(s string) ([]time.Duration, error) {
+	var backoff []time.Duration
+	for _, item := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry backoff %q: %w", s, err)
+		}
+		if d <= 0 || d%time.Millisecond != 0 {
+			return nil, fmt.Errorf("invalid retry backoff %q: %s must be a positive number of milliseconds", s, d)
+		}
+		backoff = append(backoff, d)
+	}
+	return backoff, nil
+}
+
+// Method 4: direct exchange with retry queue and DLQ
+func SubscriberWithRetry(ctx context.Context, payload *SubscriberPayload) {
+	fmt.Printf("Subscribing with retry to topic: %s\n", payload.Topic)
+
+	backoff := payload.RetryBackoff
+	if len(backoff) == 0 {
+		backoff = DefaultRetryBackoff
+	}
+	topology := RetryTopology(payload.Topic, backoff).WithQueueType(payload.QueueType, payload.DeliveryLimit)
+	mainQueueName := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
+	payload.limit(topology, mainQueueName)
+	if payload.SingleActive {
+		topology.WithSingleActiveConsumer(mainQueueName)
+	}
+
+	setup := func(ch Channel) (string, error) {
+		return mainQueueName, topology.Apply(ch)
+	}
+
+	handler := payload.handler()
+
+	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	if err := runWorkers(ctx, payload, "worker-retry", setup, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		ProcessWithRetry(ctx, payload.Topic, handler, backoff, d, ch)
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// Headers set on messages moved to the DLQ by ProcessWithRetry
+const (
+	HeaderDLQReason      = "x-dlq-reason"       // why the message failed
+	HeaderDeadLetteredAt = "x-dead-lettered-at" // when it was moved
+)
+
+// ProcessWithRetry runs handler. Transient failures are retried
+// through the retry tier for the attempt, backoff[retries], and moved to the
+// DLQ once every tier has been used. Permanent failures skip the retries,
+// and failures while the circuit breaker is open are requeued unchanged.
+func ProcessWithRetry(ctx context.Context, service string, handler Handler, backoff []time.Duration, d amqp.Delivery, ch ConfirmPublisher) {
+	maxRetries := len(backoff)
 
 	retries := getRetryCount(d)
 
-	err := doWork(d.Body)
+	err := handler.Handle(ctx, d)
 
 	if err == nil {
 		d.Ack(false)
 		return
 	}
+	spanError(ctx, err)
 
-	if retries >= maxRetries {
+	if errors.Is(err, ErrCircuitOpen) {
+		// The dependency is down, so keep the attempt for when it is back
+		log.Printf("Requeueing message without retry: %v", err)
+		spanEvent(ctx, "requeue")
+		_ = d.Nack(false, true)
+		return
+	}
+
+	if IsPermanent(err) {
+		log.Printf("Moving to DLQ without retry: %v", err)
+		spanEvent(ctx, "dead-letter", attribute.String("reason", err.Error()), attribute.Int("retries", retries))
+		if pubErr := publishToDLQ(ctx, QueueRef{Service: service, Kind: util.DLQ}, d, ch, err.Error()); pubErr != nil {
+			log.Printf("Failed to publish to DLQ: %v; nacking for requeue", pubErr)
+			_ = d.Nack(false, true)
+			return
+		}
+		metrics.deadLettered.Add(ctx, 1, metricLabels(ctx, attribute.String("cause", "permanent")))
+	} else if retries >= maxRetries {
 		totalAttempts := retries + 1
-		log.Printf("Moving to DLQ after %d attempts", totalAttempts)
-		dlxExchange := util.GetExchangeName(service, util.DLX)
-		dlqName := util.GetQueueName(service, "main", util.DLQ)
-		if pubErr := ch.PublishWithContext(
-			context.Background(),
-			dlxExchange,
-			dlqName,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        d.Body,
-				Headers:     d.Headers,
-			},
-		); pubErr != nil {
+		log.Printf("Moving to DLQ after %d attempts: %v", totalAttempts, err)
+		reason := fmt.Sprintf("retries exhausted after %d attempts: %v", totalAttempts, err)
+		spanEvent(ctx, "dead-letter", attribute.String("reason", reason), attribute.Int("retries", retries))
+		if pubErr := publishToDLQ(ctx, QueueRef{Service: service, Kind: util.DLQ}, d, ch, reason); pubErr != nil {
 			log.Printf("Failed to publish to DLQ: %v; nacking for requeue", pubErr)
 			_ = d.Nack(false, true)
 			return
 		}
+		metrics.deadLettered.Add(ctx, 1, metricLabels(ctx, attribute.String("cause", "retries_exhausted")))
 	} else {
-		delayDuration := int64(math.Pow(float64(retries+1), 2)) * 1000
+		delay := backoff[retries]
+		tier := retryTierQueueName(service, delay)
+
+		log.Printf("Retrying message after (%d/%d) attempts in %s via %s: %v", retries+1, maxRetries+1, delay, tier, err)
 
-		log.Printf("Retrying message after (%d/%d) attempts in %dms", retries+1, maxRetries+1, delayDuration)
+		headers := amqp.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		headers[HeaderRetryCount] = int64(retries + 1)
+		spanEvent(ctx, "retry",
+			attribute.Int("retry.attempt", retries+1),
+			attribute.String("retry.delay", delay.String()),
+			attribute.String("retry.queue", tier))
 
 		retryExchange := util.GetExchangeName(service, util.Retry)
-		if pubErr := ch.PublishWithContext(
-			context.Background(),
-			retryExchange,
-			d.RoutingKey,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        d.Body,
-				Headers:     d.Headers,
-				Expiration:  fmt.Sprintf("%d", delayDuration),
-			},
+		if pubErr := ch.Publish(
+			ctx,
+			retryExchange, // exchange
+			tier,          // routing key, bound to the tier queue
+			forward(d, injectTrace(ctx, headers)),
 		); pubErr != nil {
 			log.Printf("Failed to publish to retry exchange: %v; nacking for requeue", pubErr)
 			_ = d.Nack(false, true)
 			return
 		}
+		metrics.retried.Add(ctx, 1, metricLabels(ctx, attribute.Int("attempt", retries+1)))
 	}
 	d.Ack(false)
 }
 
-func doWork(body []byte) error {
-	return nil
+// publishToDLQ publishes d to dlq through dlx.<service>.x, with the reason
+// and time of the failure in its headers, and waits for the broker to
+// confirm it. A full DLQ set to x-overflow reject-publish nacks the message,
+// so the caller must keep the original until this returns nil.
+func publishToDLQ(ctx context.Context, dlq QueueRef, d amqp.Delivery, ch ConfirmPublisher, reason string) error {
+	dlxExchange := util.GetExchangeName(dlq.Service, util.DLX)
+	dlqName := dlq.QueueName()
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDLQReason] = reason
+	headers[HeaderDeadLetteredAt] = time.Now()
+
+	return ch.Publish(
+		ctx,
+		dlxExchange, // exchange
+		dlqName,     // routing key, bound to the DLQ
+		forward(d, injectTrace(ctx, headers)),
+	)
 }
 
+// getRetryCount returns how many times the message has been retried. The
+// x-retry-count header set by ProcessWithRetry is used when present. Otherwise
+// the count of the most recent x-death entry is used, which is only accurate
+// for messages that always die in the same queue.
 func getRetryCount(d amqp.Delivery) int {
+	if n, ok := toInt(d.Headers[HeaderRetryCount]); ok {
+		return n
+	}
+
 	// x-death can be []interface{} (array of tables) or amqp.Table (single entry)
 	var entries []interface{}
 	switch v := d.Headers["x-death"].(type) {
@@ -97,20 +245,26 @@ func getRetryCount(d amqp.Delivery) int {
 		return 0
 	}
 
-	// count can be int64, int, uint64 depending on RabbitMQ/AMQP version
-	switch v := deathInfo["count"].(type) {
+	n, _ := toInt(deathInfo["count"])
+	return n
+}
+
+// toInt converts a numeric header value. Counts can be int64, int, uint64
+// etc. depending on RabbitMQ/AMQP version.
+func toInt(v interface{}) (int, bool) {
+	switch v := v.(type) {
 	case int64:
-		return int(v)
+		return int(v), true
 	case int:
-		return v
+		return v, true
 	case int32:
-		return int(v)
+		return int(v), true
 	case uint64:
-		return int(v)
+		return int(v), true
 	case uint32:
-		return int(v)
+		return int(v), true
 	case float64:
-		return int(v)
+		return int(v), true
 	}
-	return 0
+	return 0, false
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+var errDependencyDown = errors.New("dependency down")
+
+// failingHandler fails with err on every call and counts the calls
+type failingHandler struct {
+	err   error
+	calls int
+}
+
+func (h *failingHandler) Handle(ctx context.Context, d amqp.Delivery) error {
+	h.calls++
+	return h.err
+}
+
+// newRetryBroker declares the retry topology of service on a fake broker
+// and publishes body to its main queue
+func newRetryBroker(t *testing.T, service string, backoff []time.Duration, body string) (*fakeBroker, *fakeChannel) {
+	t.Helper()
+	b := newFakeBroker()
+	ch := b.Channel()
+	if err := RetryTopology(service, backoff).Apply(ch); err != nil {
+		t.Fatalf("apply topology: %v", err)
+	}
+	err := ch.Publish(context.Background(),
+		util.GetExchangeName(service, util.Events),
+		util.GetQueueName(service, "main", util.NormalQueue),
+		amqp.Publishing{MessageId: "m-1", Body: []byte(body)},
+	)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	return b, ch
+}
+
+func mustGet(t *testing.T, b *fakeBroker, queue string) amqp.Delivery {
+	t.Helper()
+	d, ok := b.Get(queue)
+	if !ok {
+		t.Fatalf("no message in %s", queue)
+	}
+	return d
+}
+
+func TestProcessWithRetryUsesEveryTierThenDLQ(t *testing.T) {
+	backoff := []time.Duration{time.Second, 4 * time.Second, 9 * time.Second}
+	b, ch := newRetryBroker(t, "orders", backoff, `{"id":1}`)
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+	handler := &failingHandler{err: errDependencyDown}
+
+	for i, delay := range backoff {
+		d := mustGet(t, b, mainQueue)
+		if got := getRetryCount(d); got != i {
+			t.Fatalf("attempt %d: retry count = %d, want %d", i+1, got, i)
+		}
+		if i > 0 {
+			deaths := decodeXDeath(d.Headers)
+			prev := retryTierQueueName("orders", backoff[i-1])
+			if len(deaths) == 0 || deaths[0].Queue != prev || deaths[0].Reason != "expired" {
+				t.Fatalf("attempt %d: x-death = %+v, want expired from %s", i+1, deaths, prev)
+			}
+		}
+
+		ProcessWithRetry(context.Background(), "orders", handler, backoff, d, ch)
+
+		tier := retryTierQueueName("orders", delay)
+		if n := b.Len(tier); n != 1 {
+			t.Fatalf("attempt %d: %s has %d messages, want 1", i+1, tier, n)
+		}
+		b.Advance(delay - time.Millisecond)
+		if n := b.Len(mainQueue); n != 0 {
+			t.Fatalf("attempt %d: message retried before %s", i+1, delay)
+		}
+		b.Advance(time.Millisecond)
+	}
+
+	d := mustGet(t, b, mainQueue)
+	ProcessWithRetry(context.Background(), "orders", handler, backoff, d, ch)
+
+	if handler.calls != len(backoff)+1 {
+		t.Errorf("handler called %d times, want %d", handler.calls, len(backoff)+1)
+	}
+	dead := mustGet(t, b, util.GetQueueName("orders", "main", util.DLQ))
+	reason, _ := dead.Headers[HeaderDLQReason].(string)
+	if !strings.Contains(reason, "retries exhausted after 4 attempts") || !strings.Contains(reason, errDependencyDown.Error()) {
+		t.Errorf("x-dlq-reason = %q", reason)
+	}
+	if dead.MessageId != "m-1" {
+		t.Errorf("DLQ message ID = %q, want m-1", dead.MessageId)
+	}
+	_ = dead.Ack(false)
+	if n := b.Unacked(); n != 0 {
+		t.Errorf("%d messages left unacked", n)
+	}
+}
+
+func TestProcessWithRetryOutcomes(t *testing.T) {
+	backoff := []time.Duration{time.Second}
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+	dlq := util.GetQueueName("orders", "main", util.DLQ)
+	tier := retryTierQueueName("orders", time.Second)
+
+	tests := []struct {
+		name      string
+		err       error
+		wantQueue string // where the message ends up, "" when acked
+	}{
+		{name: "success", err: nil},
+		{name: "transient", err: errDependencyDown, wantQueue: tier},
+		{name: "permanent", err: Permanent(errDependencyDown), wantQueue: dlq},
+		{name: "invalid payload", err: fmt.Errorf("%w: bad json", ErrInvalidPayload), wantQueue: dlq},
+		{name: "circuit open", err: fmt.Errorf("%w: %w", ErrCircuitOpen, errDependencyDown), wantQueue: mainQueue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ch := newRetryBroker(t, "orders", backoff, `{"id":1}`)
+			d := mustGet(t, b, mainQueue)
+
+			ProcessWithRetry(context.Background(), "orders", &failingHandler{err: tt.err}, backoff, d, ch)
+
+			for _, q := range []string{mainQueue, tier, dlq} {
+				want := 0
+				if q == tt.wantQueue {
+					want = 1
+				}
+				if n := b.Len(q); n != want {
+					t.Errorf("%s has %d messages, want %d", q, n, want)
+				}
+			}
+			if n := b.Unacked(); n != 0 {
+				t.Errorf("%d messages left unacked", n)
+			}
+		})
+	}
+}
+
+func TestProcessWithRetryCircuitOpenKeepsAttempt(t *testing.T) {
+	backoff := []time.Duration{time.Second}
+	b, ch := newRetryBroker(t, "orders", backoff, `{"id":1}`)
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+
+	ProcessWithRetry(context.Background(), "orders", &failingHandler{err: errDependencyDown}, backoff, mustGet(t, b, mainQueue), ch)
+	b.Advance(time.Second)
+
+	open := &failingHandler{err: fmt.Errorf("%w: %w", ErrCircuitOpen, errDependencyDown)}
+	ProcessWithRetry(context.Background(), "orders", open, backoff, mustGet(t, b, mainQueue), ch)
+
+	d := mustGet(t, b, mainQueue)
+	if !d.Redelivered {
+		t.Error("message was not requeued")
+	}
+	if got := getRetryCount(d); got != 1 {
+		t.Errorf("retry count = %d, want 1", got)
+	}
+}
+
+// unpublishableChannel fails every publish
+type unpublishableChannel struct {
+	ConfirmPublisher
+}
+
+func (c unpublishableChannel) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	return errors.New("channel closed")
+}
+
+func TestProcessWithRetryRequeuesWhenPublishFails(t *testing.T) {
+	backoff := []time.Duration{time.Second}
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+
+	for _, err := range []error{errDependencyDown, Permanent(errDependencyDown)} {
+		b, ch := newRetryBroker(t, "orders", backoff, `{"id":1}`)
+		ProcessWithRetry(context.Background(), "orders", &failingHandler{err: err}, backoff, mustGet(t, b, mainQueue), unpublishableChannel{ch})
+
+		d, ok := b.Get(mainQueue)
+		if !ok || !d.Redelivered {
+			t.Errorf("%v: message was not requeued", err)
+		}
+	}
+}
+
+func TestProcessWithRetryKeepsMessagesRefusedByFullDLQ(t *testing.T) {
+	backoff := []time.Duration{time.Second}
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+	dlq := util.GetQueueName("orders", "main", util.DLQ)
+
+	b := newFakeBroker()
+	ch := b.Channel()
+	topology := RetryTopology("orders", backoff).WithLimits(dlq, QueueLimits{MaxLength: 1, Overflow: util.RejectPublish})
+	if err := topology.Apply(ch); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ch.Publish(context.Background(), util.GetExchangeName("orders", util.Events), mainQueue, amqp.Publishing{Body: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := &failingHandler{err: Permanent(errDependencyDown)}
+	for i := 0; i < 2; i++ {
+		ProcessWithRetry(context.Background(), "orders", handler, backoff, mustGet(t, b, mainQueue), ch)
+	}
+	if n := b.Len(dlq); n != 1 {
+		t.Errorf("DLQ has %d messages, want 1", n)
+	}
+	// The nacked DLQ publish leaves the second message in the main queue
+	if n := b.Len(mainQueue); n != 1 {
+		t.Errorf("main queue has %d messages, want 1", n)
+	}
+}
+
+func TestGetRetryCount(t *testing.T) {
+	xDeath := func(count interface{}) amqp.Table {
+		return amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "q.orders.main.retry.4s", "reason": "expired", "count": count},
+			amqp.Table{"queue": "q.orders.main.retry.1s", "reason": "expired", "count": int64(9)},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{"no headers", nil, 0},
+		{"x-retry-count int64", amqp.Table{HeaderRetryCount: int64(2)}, 2},
+		{"x-retry-count int", amqp.Table{HeaderRetryCount: 2}, 2},
+		{"x-retry-count int32", amqp.Table{HeaderRetryCount: int32(2)}, 2},
+		{"x-retry-count uint64", amqp.Table{HeaderRetryCount: uint64(2)}, 2},
+		{"x-retry-count uint32", amqp.Table{HeaderRetryCount: uint32(2)}, 2},
+		{"x-retry-count float64", amqp.Table{HeaderRetryCount: float64(2)}, 2},
+		{"x-retry-count string is ignored", amqp.Table{HeaderRetryCount: "2"}, 0},
+		{"x-retry-count wins over x-death", amqp.Table{HeaderRetryCount: int64(1), "x-death": xDeath(int64(3))["x-death"]}, 1},
+		{"x-death int64", xDeath(int64(3)), 3},
+		{"x-death int", xDeath(3), 3},
+		{"x-death int32", xDeath(int32(3)), 3},
+		{"x-death uint64", xDeath(uint64(3)), 3},
+		{"x-death uint32", xDeath(uint32(3)), 3},
+		{"x-death float64", xDeath(float64(3)), 3},
+		{"x-death string count", xDeath("3"), 0},
+		{"x-death single table", amqp.Table{"x-death": amqp.Table{"count": int64(4)}}, 4},
+		{"x-death empty", amqp.Table{"x-death": []interface{}{}}, 0},
+		{"x-death not a table", amqp.Table{"x-death": []interface{}{"expired"}}, 0},
+		{"x-death wrong type", amqp.Table{"x-death": "expired"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getRetryCount(amqp.Delivery{Headers: tt.headers}); got != tt.want {
+				t.Errorf("getRetryCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryBackoff(t *testing.T) {
+	got, err := ParseRetryBackoff("1s, 500ms,2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{time.Second, 500 * time.Millisecond, 2 * time.Minute}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ParseRetryBackoff() = %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"", "1s,,2s", "-1s", "0s", "1.5ms", "soon"} {
+		if _, err := ParseRetryBackoff(s); err == nil {
+			t.Errorf("ParseRetryBackoff(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -1,280 +1,395 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
 )
 
-// Main Queue -> DLX -> DLQ
-
 type SubscriberPayload struct {
-	Channel *amqp.Channel
-	Topic   string
+	Conn     Consumer
+	Topic    string
+	Prefetch int      // max unacked messages per consumer
+	Workers  int      // consumers, each on its own channel; fanout supports 1
+	Purpose  string   // queue purpose for topic subscribers, defaults to "main"
+	Bindings []string // topic binding patterns, defaults to the queue name
+	// Headers are matched by headers exchange subscribers, all of them or
+	// any of them depending on Match
+	Headers map[string]string
+	Match   util.HeadersMatch
+	// SingleActive declares the queue with x-single-active-consumer, so only
+	// one consumer across all processes receives messages, in order
+	SingleActive bool
+	// Partitions is the number of sub-queues of a partitioned subscriber.
+	// PartitionIDs selects the ones this process consumes, defaults to all.
+	Partitions   int
+	PartitionIDs []int
+	// Limits bound the queues the subscriber consumes, DLQLimits its DLQ
+	Limits    QueueLimits
+	DLQLimits QueueLimits
+	// QueueType is classic (default), quorum or stream. DeliveryLimit sets
+	// x-delivery-limit on quorum queues that dead-letter.
+	QueueType     util.QueueKind
+	DeliveryLimit int
+	StreamOffset  string // where a stream subscriber starts, see ParseStreamOffset
+	// RetryBackoff is the delay before each retry of subscribe-retry,
+	// defaults to DefaultRetryBackoff
+	RetryBackoff []time.Duration
+	// Schemas validates every delivery before the handler runs, when set
+	Schemas *SchemaRegistry
+	// Dedup skips deliveries that were already handled successfully, when set
+	Dedup *Deduplicator
+	// Breaker pauses the consumers while the handler keeps failing, when set
+	Breaker *CircuitBreaker
+	// ShutdownTimeout bounds how long in-flight messages may take after shutdown
+	ShutdownTimeout time.Duration
 }
 
-// Method 1: direct exchange
-func Subscriber(payload *SubscriberPayload) {
-	fmt.Printf("Subscribing to topic: %s\n", payload.Topic)
-
-	dlxExchange := util.GetExchangeName(payload.Topic, util.DLX)
-	dlqName := util.GetQueueName(payload.Topic, "main", util.DLQ)
-	mainExchange := util.GetExchangeName(payload.Topic, util.Events)
-	mainQueueName := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
-	routingKey := mainQueueName
-
-	// Declare the DLX exchange
-	if err := payload.Channel.ExchangeDeclare(
-		dlxExchange, // name
-		"direct",    // type
-		true,        // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // no-wait
-		nil,        // arguments
-	); err != nil {
-		panic(err)
+// handler returns the topic's handler, recording outcomes in Breaker,
+// validating against Schemas and skipping duplicates when set
+func (p *SubscriberPayload) handler() Handler {
+	h := timedHandler(HandlerFor(p.Topic))
+	if p.Breaker != nil {
+		h = p.Breaker.Handler(h)
 	}
-
-	// Declare the DLQ queue
-	if _, err := payload.Channel.QueueDeclare(
-		dlqName, // name
-		true,    // durable
-		false,   // delete when unused
-		false,   // exclusive
-		false,   // no-wait
-		nil,     // arguments
-	); err != nil {
-		panic(err)
+	if p.Schemas != nil {
+		h = ValidatingHandler(p.Schemas, h)
 	}
-
-	// Bind the DLQ queue to the DLX exchange
-	if err := payload.Channel.QueueBind(
-		dlqName,     // queue name
-		dlqName,     // routing key
-		dlxExchange, // exchange
-		false,       // no-wait
-		nil,         // arguments
-	); err != nil {
-		panic(err)
+	if p.Dedup != nil {
+		h = p.Dedup.Handler(p.Topic, h)
 	}
+	return h
+}
 
-	// Declare the main exchange
-	if err := payload.Channel.ExchangeDeclare(
-		mainExchange, // name
-		"direct",     // type
-		true,         // durable
-		false,        // auto-deleted
-		false,        // internal
-		false,        // no-wait
-		nil,          // arguments
-	); err != nil {
-		panic(err)
+// limit sets Limits on the named queues and DLQLimits on every DLQ of t
+func (p *SubscriberPayload) limit(t *Topology, queues ...string) *Topology {
+	for _, queue := range queues {
+		t.WithLimits(queue, p.Limits)
+	}
+	for _, q := range t.Queues {
+		if q.Kind == util.DLQ {
+			t.WithLimits(q.QueueName(), p.DLQLimits)
+		}
 	}
+	return t
+}
 
-	args := amqp.Table{
-		"x-dead-letter-exchange":    dlxExchange,
-		"x-dead-letter-routing-key": dlqName,
+// withDeadLetter dead-letters queue to q.<service>.<purpose>.dlq through
+// dlx.<service>.x, and returns the DLQ
+func withDeadLetter(t *Topology, queue QueueRef) QueueRef {
+	dlx := ExchangeRef{Service: queue.Service, Kind: util.DLX}
+	dlq := QueueRef{Service: queue.Service, Purpose: queue.Purpose, Kind: util.DLQ}
+	for i := range t.Queues {
+		if t.Queues[i].QueueName() == queue.QueueName() {
+			t.Queues[i].DeadLetter = &DeadLetterSpec{Exchange: dlx, Queue: &dlq}
+		}
 	}
+	t.Merge(&Topology{
+		Exchanges: []ExchangeSpec{{ExchangeRef: dlx, Type: "direct", Durable: true}},
+		Queues:    []QueueSpec{{QueueRef: dlq, Type: queueTypeOf(t, queue), Durable: true}},
+		Bindings:  []BindingSpec{{Exchange: dlx, Queue: dlq}},
+	})
+	return dlq
+}
 
-	// Declare the main queue
-	q, err := payload.Channel.QueueDeclare(
-		mainQueueName, // name
-		true,          // durable
-		false,         // delete when unused
-		false,         // exclusive
-		false,         // no-wait
-		args,          // arguments
-	)
-	if err != nil {
-		panic(err)
+// queueTypeOf returns the type of the named queue in t
+func queueTypeOf(t *Topology, queue QueueRef) util.QueueKind {
+	for _, q := range t.Queues {
+		if q.QueueName() == queue.QueueName() {
+			return q.Type
+		}
 	}
+	return ""
+}
 
-	// Bind the queue to the exchange
-	if err := payload.Channel.QueueBind(
-		q.Name,        // queue name
-		routingKey,    // routing key
-		mainExchange,  // exchange
-		false,         // no-wait
-		nil,           // arguments
-	); err != nil {
-		panic(err)
+// Main Queue -> DLX -> DLQ
+func DirectTopology(service string) *Topology {
+	mainQueue := QueueRef{Service: service, Kind: util.NormalQueue}
+	dlq := QueueRef{Service: service, Kind: util.DLQ}
+	dlx := ExchangeRef{Service: service, Kind: util.DLX}
+	mainExchange := ExchangeRef{Service: service, Kind: util.Events}
+
+	return &Topology{
+		Exchanges: []ExchangeSpec{
+			{ExchangeRef: dlx, Type: "direct", Durable: true},
+			{ExchangeRef: mainExchange, Type: "direct", Durable: true},
+		},
+		Queues: []QueueSpec{
+			{QueueRef: dlq, Durable: true},
+			{
+				QueueRef:   mainQueue,
+				Durable:    true,
+				DeadLetter: &DeadLetterSpec{Exchange: dlx, Queue: &dlq},
+			},
+		},
+		Bindings: []BindingSpec{
+			{Exchange: dlx, Queue: dlq},
+			{Exchange: mainExchange, Queue: mainQueue},
+		},
 	}
+}
 
-	// Consume messages
-	msgs, err := payload.Channel.Consume(
-		q.Name,     // queue
-		"worker-1", // consumer tag
-		false,      // auto-ack = false → manual ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
-	if err != nil {
-		panic(err)
+// Method 1: direct exchange
+func Subscriber(ctx context.Context, payload *SubscriberPayload) {
+	fmt.Printf("Subscribing to topic: %s\n", payload.Topic)
+
+	topology := DirectTopology(payload.Topic).WithQueueType(payload.QueueType, payload.DeliveryLimit)
+	mainQueueName := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
+	payload.limit(topology, mainQueueName)
+	if payload.SingleActive {
+		topology.WithSingleActiveConsumer(mainQueueName)
 	}
 
-	forever := make(chan bool)
+	setup := func(ch Channel) (string, error) {
+		return mainQueueName, topology.Apply(ch)
+	}
 
-	go func() {
-		for d := range msgs {
-			log.Printf("consumed: %v", string(d.Body))
-			d.Ack(false)
-			// d.Nack(false, true) // requeue = true
-			// d.Reject(true) // requeue = true
-		}
-	}()
+	handler := payload.handler()
+	// With a delivery limit the quorum queue dead-letters messages that keep failing
+	requeue := payload.QueueType == util.QuorumQueue && payload.DeliveryLimit > 0
+	dlq := QueueRef{Service: payload.Topic, Kind: util.DLQ}
 
 	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+	if err := runWorkers(ctx, payload, "worker", setup, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		handleDelivery(ctx, handler, ch, d, &dlq, requeue)
+	}); err != nil {
+		panic(err)
+	}
 }
 
 // Method 2: topic exchange
-func SubscriberTopic(payload *SubscriberPayload) {
+func SubscriberTopic(ctx context.Context, payload *SubscriberPayload) {
 	fmt.Printf("Subscribing to topic exchange: %s\n", payload.Topic)
 
-	exchange := util.GetExchangeName(payload.Topic, util.Events)
-	queueName := util.GetQueueName(payload.Topic, "main", util.NormalQueue)
-	routingKey := queueName
-
-	// Declare the exchange
-	if err := payload.Channel.ExchangeDeclare(
-		exchange, // name
-		"topic",  // type
-		true,     // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // no-wait
-		nil,      // arguments
-	); err != nil {
-		panic(err)
+	exchange := ExchangeRef{Service: payload.Topic, Kind: util.Events}
+	queue := QueueRef{Service: payload.Topic, Purpose: payload.Purpose, Kind: util.NormalQueue}
+	topology := &Topology{
+		Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: "topic", Durable: true}},
+		Queues:    []QueueSpec{{QueueRef: queue, Durable: true}},
 	}
 
-	// Declare the queue
-	q, err := payload.Channel.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
-	if err != nil {
-		panic(err)
+	patterns := payload.Bindings
+	if len(patterns) == 0 {
+		patterns = []string{queue.QueueName()}
+	}
+	for _, pattern := range patterns {
+		if err := util.ValidateBindingKey(pattern); err != nil {
+			panic(err)
+		}
+		topology.Bindings = append(topology.Bindings, BindingSpec{Exchange: exchange, Queue: queue, RoutingKey: pattern})
+	}
+	log.Printf("Binding %s to %s with %s", queue.QueueName(), exchange.ExchangeName(), strings.Join(patterns, ", "))
+	dlq := withDeadLetter(topology, queue)
+	topology.WithQueueType(payload.QueueType, payload.DeliveryLimit)
+	payload.limit(topology, queue.QueueName())
+	if payload.SingleActive {
+		topology.WithSingleActiveConsumer(queue.QueueName())
 	}
 
-	// Bind the queue to the exchange
-	if err := payload.Channel.QueueBind(
-		q.Name,      // queue name
-		routingKey,  // routing key
-		exchange,    // exchange
-		false,       // no-wait
-		nil,         // arguments
-	); err != nil {
-		panic(err)
+	setup := func(ch Channel) (string, error) {
+		return queue.QueueName(), topology.Apply(ch)
 	}
 
-	// Consume messages
-	msgs, err := payload.Channel.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack = false → manual ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if err != nil {
+	handler := payload.handler()
+	// With a delivery limit the quorum queue dead-letters messages that keep failing
+	requeue := payload.QueueType == util.QuorumQueue && payload.DeliveryLimit > 0
+
+	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	if err := runWorkers(ctx, payload, "worker", setup, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		handleDelivery(ctx, handler, ch, d, &dlq, requeue)
+	}); err != nil {
 		panic(err)
 	}
+}
+
+// Method 3: fanout exchange
+func SubscriberFanout(ctx context.Context, payload *SubscriberPayload) {
+	fmt.Printf("Subscribing to fanout exchange: %s\n", payload.Topic)
 
-	forever := make(chan bool)
+	exchange := ExchangeSpec{
+		ExchangeRef: ExchangeRef{Service: payload.Topic, Kind: util.Events},
+		Type:        "fanout",
+		Durable:     true,
+	}
+	// Empty name for fanout to get a random, exclusive queue per subscriber
+	queue := QueueSpec{AutoDelete: true, Exclusive: true, QueueLimits: payload.Limits}
 
-	go func() {
-		for d := range msgs {
-			log.Printf("consumed from topic exchange: %v", string(d.Body))
-			d.Ack(false)
-			// d.Nack(false, true) // requeue = true
-			// d.Reject(true) // requeue = true
+	setup := func(ch Channel) (string, error) {
+		if err := exchange.Declare(ch); err != nil {
+			return "", err
+		}
+		q, err := queue.Declare(ch)
+		if err != nil {
+			return "", err
+		}
+		binding := BindingSpec{
+			Exchange:   exchange.ExchangeRef,
+			Queue:      QueueRef{Name: q.Name},
+			RoutingKey: "", // ignored by fanout exchanges
 		}
-	}()
+		return q.Name, binding.Declare(ch)
+	}
+
+	handler := payload.handler()
 
 	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+	if err := runWorkers(ctx, payload, "worker", setup, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		// The exclusive queue has no DLQ, failed messages are dropped
+		handleDelivery(ctx, handler, ch, d, nil, false)
+	}); err != nil {
+		panic(err)
+	}
 }
 
-// Method 3: fanout exchange
-func SubscriberFanout(payload *SubscriberPayload) {
-	fmt.Printf("Subscribing to fanout exchange: %s\n", payload.Topic)
+// Method 7: headers exchange
+func SubscriberHeaders(ctx context.Context, payload *SubscriberPayload) {
+	fmt.Printf("Subscribing to headers exchange: %s\n", payload.Topic)
 
-	exchange := util.GetExchangeName(payload.Topic, util.Events)
-
-	// Declare the exchange
-	if err := payload.Channel.ExchangeDeclare(
-		exchange, // name
-		"fanout", // type
-		true,     // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // no-wait
-		nil,      // arguments
-	); err != nil {
+	exchange := ExchangeRef{Service: payload.Topic, Kind: util.Events}
+	queue := QueueRef{Service: payload.Topic, Purpose: payload.Purpose, Kind: util.NormalQueue}
+	binding := BindingSpec{Exchange: exchange, Queue: queue, Headers: map[string]interface{}{}, Match: payload.Match}
+	for k, v := range payload.Headers {
+		binding.Headers[k] = v
+	}
+	if binding.Match == "" {
+		binding.Match = util.MatchAll
+	}
+	if err := binding.Validate(); err != nil {
 		panic(err)
 	}
+	topology := &Topology{
+		Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: "headers", Durable: true}},
+		Queues:    []QueueSpec{{QueueRef: queue, Durable: true}},
+		Bindings:  []BindingSpec{binding},
+	}
+	log.Printf("Binding %s to %s with x-match=%s %v", queue.QueueName(), exchange.ExchangeName(), binding.Match, payload.Headers)
+	dlq := withDeadLetter(topology, queue)
+	topology.WithQueueType(payload.QueueType, payload.DeliveryLimit)
+	payload.limit(topology, queue.QueueName())
+	if payload.SingleActive {
+		topology.WithSingleActiveConsumer(queue.QueueName())
+	}
 
-	// Declare the queue
-	q, err := payload.Channel.QueueDeclare(
-		"",    // name (empty for fanout to get a random queue name)
-		false, // durable
-		true,  // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		panic(err)
+	setup := func(ch Channel) (string, error) {
+		return queue.QueueName(), topology.Apply(ch)
 	}
 
-	// Bind the queue to the exchange
-	if err := payload.Channel.QueueBind(
-		q.Name,   // queue name
-		"",       // routing key (empty for fanout)
-		exchange, // exchange
-		false,    // no-wait
-		nil,      // arguments
-	); err != nil {
+	handler := payload.handler()
+	// With a delivery limit the quorum queue dead-letters messages that keep failing
+	requeue := payload.QueueType == util.QuorumQueue && payload.DeliveryLimit > 0
+
+	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	if err := runWorkers(ctx, payload, "worker", setup, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		handleDelivery(ctx, handler, ch, d, &dlq, requeue)
+	}); err != nil {
 		panic(err)
 	}
+}
+
+// Method 8: consistent-hash exchange. Messages are spread across
+// payload.Partitions sub-queues by routing key, and every sub-queue has a
+// single active consumer, so the messages of one key are handled in order.
+func SubscriberPartitioned(ctx context.Context, payload *SubscriberPayload) {
+	fmt.Printf("Subscribing to %d partitions of topic: %s\n", payload.Partitions, payload.Topic)
+
+	purpose := payload.Purpose
+	if purpose == "" {
+		purpose = "main"
+	}
+	topology := PartitionedTopology(payload.Topic, purpose, payload.Partitions).WithQueueType(payload.QueueType, payload.DeliveryLimit)
+	// Every process declares every partition, so they all get the same limits
+	for i := 0; i < payload.Partitions; i++ {
+		payload.limit(topology, PartitionQueue(payload.Topic, purpose, i).QueueName())
+	}
+
+	ids := payload.PartitionIDs
+	if len(ids) == 0 {
+		for i := 0; i < payload.Partitions; i++ {
+			ids = append(ids, i)
+		}
+	}
+	consumers := make([]consumerSpec, 0, len(ids))
+	for _, id := range ids {
+		if id < 0 || id >= payload.Partitions {
+			panic(fmt.Sprintf("partition %d out of range, topic %s has %d partitions", id, payload.Topic, payload.Partitions))
+		}
+		queue := PartitionQueue(payload.Topic, purpose, id).QueueName()
+		consumers = append(consumers, consumerSpec{
+			tag: fmt.Sprintf("partition-%d", id),
+			setup: func(ch Channel) (string, error) {
+				return queue, topology.Apply(ch)
+			},
+		})
+	}
 
-	// Consume messages
-	msgs, err := payload.Channel.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack = false → manual ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if err != nil {
+	handler := payload.handler()
+	requeue := payload.QueueType == util.QuorumQueue && payload.DeliveryLimit > 0
+	dlq := QueueRef{Service: payload.Topic, Purpose: purpose, Kind: util.DLQ}
+	partitioned := *payload
+	partitioned.SingleActive = true
+
+	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	if err := runConsumers(ctx, &partitioned, consumers, func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		handleDelivery(ctx, handler, ch, d, &dlq, requeue)
+	}); err != nil {
 		panic(err)
 	}
+}
 
-	forever := make(chan bool)
+// handleDelivery runs handler for a delivery. Failed messages are nacked without
+// requeue, which dead-letters them when the queue has a DLX configured. With
+// requeue set, transient failures are returned to the queue instead and the
+// quorum queue's x-delivery-limit decides when to dead-letter.
+//
+// When dlq is set, permanent failures such as schema violations are
+// published to it with the error in the x-dlq-reason header, and only acked
+// once the broker confirmed the publish; a nacked or returned publish
+// requeues them. Failures while the circuit breaker is open are always
+// requeued.
+func handleDelivery(ctx context.Context, handler Handler, ch ConfirmPublisher, d amqp.Delivery, dlq *QueueRef, requeue bool) {
+	err := handler.Handle(ctx, d)
+	if err == nil {
+		d.Ack(false)
+		return
+	}
 
-	go func() {
-		for d := range msgs {
-			log.Printf("consumed from fanout exchange: %v", string(d.Body))
+	spanError(ctx, err)
+	permanent := IsPermanent(err)
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		log.Printf("handler failed, requeueing message: %v", err)
+		spanEvent(ctx, "requeue")
+		d.Nack(false, true) // requeue = true
+		return
+	case permanent && dlq != nil:
+		log.Printf("handler failed permanently, moving to DLQ: %v", err)
+		spanEvent(ctx, "dead-letter", attribute.String("reason", err.Error()))
+		pubErr := publishToDLQ(ctx, *dlq, d, ch, err.Error())
+		if pubErr == nil {
+			metrics.deadLettered.Add(ctx, 1, metricLabels(ctx, attribute.String("cause", "permanent")))
 			d.Ack(false)
-			// d.Nack(false, true) // requeue = true
-			// d.Reject(true) // requeue = true
+			return
 		}
-	}()
-
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+		// The DLQ may be full; rejecting would dead-letter into it as well
+		log.Printf("Failed to publish to DLQ: %v; nacking for requeue", pubErr)
+		d.Nack(false, true) // requeue = true
+		return
+	case requeue && !permanent:
+		log.Printf("handler failed, requeueing message (redelivered: %t): %v", d.Redelivered, err)
+		spanEvent(ctx, "requeue")
+		d.Nack(false, true) // requeue = true
+		return
+	default:
+		log.Printf("handler failed, rejecting message: %v", err)
+	}
+	spanEvent(ctx, "reject")
+	d.Nack(false, false) // requeue = false
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+func TestHandleDelivery(t *testing.T) {
+	mainQueue := util.GetQueueName("orders", "main", util.NormalQueue)
+	dlq := util.GetQueueName("orders", "main", util.DLQ)
+
+	tests := []struct {
+		name       string
+		err        error
+		dlq        *QueueRef
+		requeue    bool
+		wantQueue  string // where the message ends up, "" when acked
+		wantReason string // x-death reason or x-dlq-reason of the DLQ message
+	}{
+		{name: "success", err: nil},
+		{name: "transient is dead-lettered by the broker", err: errDependencyDown, wantQueue: dlq, wantReason: "rejected"},
+		{name: "transient with requeue", err: errDependencyDown, requeue: true, wantQueue: mainQueue},
+		{name: "permanent with requeue is dead-lettered", err: Permanent(errDependencyDown), requeue: true, wantQueue: dlq, wantReason: "rejected"},
+		{name: "permanent is published to the DLQ", err: Permanent(errDependencyDown), dlq: &QueueRef{Service: "orders", Kind: util.DLQ}, wantQueue: dlq, wantReason: "permanent failure: dependency down"},
+		{name: "permanent returned by the DLX is requeued", err: Permanent(errDependencyDown), dlq: &QueueRef{Service: "orders", Purpose: "unbound", Kind: util.DLQ}, wantQueue: mainQueue},
+		{name: "circuit open is requeued", err: errors.Join(ErrCircuitOpen, errDependencyDown), wantQueue: mainQueue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBroker()
+			ch := b.Channel()
+			if err := DirectTopology("orders").Apply(ch); err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.Publish(context.Background(), util.GetExchangeName("orders", util.Events), mainQueue, amqp.Publishing{Body: []byte("{}")}); err != nil {
+				t.Fatal(err)
+			}
+
+			handleDelivery(context.Background(), &failingHandler{err: tt.err}, ch, mustGet(t, b, mainQueue), tt.dlq, tt.requeue)
+
+			if n := b.Unacked(); n != 0 {
+				t.Errorf("%d messages left unacked", n)
+			}
+			for _, q := range []string{mainQueue, dlq} {
+				want := 0
+				if q == tt.wantQueue {
+					want = 1
+				}
+				if n := b.Len(q); n != want {
+					t.Fatalf("%s has %d messages, want %d", q, n, want)
+				}
+			}
+			if tt.wantQueue == mainQueue {
+				if d := mustGet(t, b, mainQueue); !d.Redelivered {
+					t.Error("requeued message is not marked redelivered")
+				}
+			}
+			if tt.wantQueue == dlq {
+				d := mustGet(t, b, dlq)
+				reason, _ := d.Headers[HeaderDLQReason].(string)
+				if deaths := decodeXDeath(d.Headers); len(deaths) > 0 {
+					reason = deaths[0].Reason
+				}
+				if reason != tt.wantReason {
+					t.Errorf("reason = %q, want %q", reason, tt.wantReason)
+				}
+			}
+		})
+	}
+}
+
+// runSubscriber starts subscribe on a fake broker and waits until it has
+// declared queue. The returned function stops it.
+func runSubscriber(t *testing.T, subscribe func(context.Context, *SubscriberPayload), payload *SubscriberPayload, b *fakeBroker, queue string) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		subscribe(ctx, payload)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !b.HasQueue(queue) {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatalf("subscriber did not declare %s", queue)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func receive(t *testing.T, ch <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+		return amqp.Delivery{}
+	}
+}
+
+func TestSubscriberReceivesPublishedMessage(t *testing.T) {
+	b := newFakeBroker()
+	topic := "test-subscriber"
+	received := make(chan amqp.Delivery, 1)
+	RegisterHandler(topic, HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		received <- d
+		return nil
+	}))
+
+	stop := runSubscriber(t, Subscriber, &SubscriberPayload{Conn: b, Topic: topic, Workers: 2},
+		b, util.GetQueueName(topic, "main", util.NormalQueue))
+	defer stop()
+
+	err := Publisher(context.Background(), &PublisherPayload{
+		Channel:  b.Channel(),
+		Topic:    topic,
+		Message:  `{"id":42}`,
+		Envelope: NewEnvelope("checkout", "order.created", "2"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, received)
+	env := EnvelopeOf(d)
+	if string(d.Body) != `{"id":42}` || env.Type != "order.created" || env.Version != "2" || env.Source != "checkout" {
+		t.Errorf("received %s with envelope %+v", d.Body, env)
+	}
+}
+
+func TestSubscriberWithRetryRecoversAfterTransientFailure(t *testing.T) {
+	b := newFakeBroker()
+	topic := "test-subscriber-retry"
+	received := make(chan amqp.Delivery, 1)
+	calls := 0
+	RegisterHandler(topic, HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		calls++
+		if calls == 1 {
+			return errDependencyDown
+		}
+		received <- d
+		return nil
+	}))
+
+	backoff := []time.Duration{time.Second}
+	stop := runSubscriber(t, SubscriberWithRetry, &SubscriberPayload{Conn: b, Topic: topic, RetryBackoff: backoff},
+		b, util.GetQueueName(topic, "main", util.NormalQueue))
+	defer stop()
+
+	if err := Publisher(context.Background(), &PublisherPayload{Channel: b.Channel(), Topic: topic, Message: `{"id":7}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	tier := retryTierQueueName(topic, time.Second)
+	deadline := time.Now().Add(time.Second)
+	for b.Len(tier) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("message never reached %s", tier)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Advance(time.Second)
+
+	d := receive(t, received)
+	if got := getRetryCount(d); got != 1 {
+		t.Errorf("retry count = %d, want 1", got)
+	}
+	if n := b.Len(util.GetQueueName(topic, "main", util.DLQ)); n != 0 {
+		t.Errorf("DLQ has %d messages, want 0", n)
+	}
+}
+
+func TestSubscriberPartitionedKeepsKeyOrder(t *testing.T) {
+	b := newFakeBroker()
+	topic := "test-subscriber-partitioned"
+	const keys, perKey = 6, 20
+
+	var mu sync.Mutex
+	received := map[string][]int{}
+	count := 0
+	done := make(chan struct{})
+	RegisterHandler(topic, HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seq, _ := strconv.Atoi(string(d.Body))
+		received[d.RoutingKey] = append(received[d.RoutingKey], seq)
+		if count++; count == keys*perKey {
+			close(done)
+		}
+		return nil
+	}))
+
+	// Declared up front, so nothing is published before the bindings exist
+	if err := PartitionedTopology(topic, "main", 3).Apply(b.Channel()); err != nil {
+		t.Fatal(err)
+	}
+	payload := &SubscriberPayload{Conn: b, Topic: topic, Partitions: 3}
+	stop := runSubscriber(t, SubscriberPartitioned, payload, b, PartitionQueue(topic, "main", 2).QueueName())
+	defer stop()
+
+	for seq := 0; seq < perKey; seq++ {
+		for k := 0; k < keys; k++ {
+			err := PublisherPartitioned(context.Background(), &PublisherPayload{
+				Channel:    b.Channel(),
+				Topic:      topic,
+				RoutingKey: fmt.Sprintf("order-%d", k),
+				Message:    strconv.Itoa(seq),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("not every message was received")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for key, seqs := range received {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("%s received out of order: %v", key, seqs)
+			}
+		}
+	}
+
+	if err := PublisherPartitioned(context.Background(), &PublisherPayload{Channel: b.Channel(), Topic: topic, Message: "{}"}); err == nil {
+		t.Error("publishing without a partition key succeeded")
+	}
+}
+
+// bindingSubscribers are the subscribers of topic and headers exchanges with
+// a payload and a publish that reaches their queue
+var bindingSubscribers = []struct {
+	name      string
+	subscribe func(context.Context, *SubscriberPayload)
+	payload   SubscriberPayload
+	publish   func(ch ConfirmPublisher, topic string) error
+}{
+	{
+		name:      "topic",
+		subscribe: SubscriberTopic,
+		payload:   SubscriberPayload{Purpose: "created", Bindings: []string{"order.*.created"}},
+		publish: func(ch ConfirmPublisher, topic string) error {
+			return PublisherTopic(context.Background(), &PublisherPayload{Channel: ch, Topic: topic, RoutingKey: "order.eu.created", Message: "{}"})
+		},
+	},
+	{
+		name:      "headers",
+		subscribe: SubscriberHeaders,
+		payload:   SubscriberPayload{Purpose: "acme", Headers: map[string]string{"tenant": "acme"}},
+		publish: func(ch ConfirmPublisher, topic string) error {
+			return PublisherHeaders(context.Background(), &PublisherPayload{Channel: ch, Topic: topic, Headers: map[string]string{"tenant": "acme"}, Message: "{}"})
+		},
+	},
+}
+
+func TestSubscriberPermanentFailureReachesDLQ(t *testing.T) {
+	for _, tt := range bindingSubscribers {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBroker()
+			topic := "test-subscriber-dlq-" + tt.name
+			RegisterHandler(topic, HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+				return fmt.Errorf("%w: missing id", ErrValidation)
+			}))
+
+			payload := tt.payload
+			payload.Conn, payload.Topic = b, topic
+			stop := runSubscriber(t, tt.subscribe, &payload, b, util.GetQueueName(topic, payload.Purpose, util.NormalQueue))
+			defer stop()
+
+			if err := tt.publish(b.Channel(), topic); err != nil {
+				t.Fatal(err)
+			}
+
+			dlq := util.GetQueueName(topic, payload.Purpose, util.DLQ)
+			deadline := time.Now().Add(time.Second)
+			for b.Len(dlq) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("message never reached %s", dlq)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			d, _ := b.Get(dlq)
+			if reason, _ := d.Headers[HeaderDLQReason].(string); !strings.Contains(reason, "missing id") {
+				t.Errorf("%s = %q, want the handler error", HeaderDLQReason, reason)
+			}
+			if deaths := decodeXDeath(d.Headers); len(deaths) != 0 {
+				t.Errorf("message was dead-lettered by the broker, not published to the DLQ: %v", deaths)
+			}
+		})
+	}
+}
+
+func TestSubscriberRequeuesWithDeliveryLimit(t *testing.T) {
+	for _, tt := range bindingSubscribers {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBroker()
+			topic := "test-subscriber-delivery-limit-" + tt.name
+			var calls atomic.Int32
+			RegisterHandler(topic, HandlerFunc(func(ctx context.Context, d amqp.Delivery) error {
+				if calls.Add(1) == 1 {
+					return errDependencyDown
+				}
+				return nil
+			}))
+
+			payload := tt.payload
+			payload.Conn, payload.Topic = b, topic
+			payload.QueueType, payload.DeliveryLimit = util.QuorumQueue, 3
+			queue := util.GetQueueName(topic, payload.Purpose, util.NormalQueue)
+			stop := runSubscriber(t, tt.subscribe, &payload, b, queue)
+			defer stop()
+
+			if err := tt.publish(b.Channel(), topic); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(time.Second)
+			for calls.Load() < 2 {
+				if time.Now().After(deadline) {
+					t.Fatalf("transient failure was not redelivered, %d calls", calls.Load())
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if n := b.Len(util.GetQueueName(topic, payload.Purpose, util.DLQ)); n != 0 {
+				t.Errorf("DLQ has %d messages, want the failure requeued", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+// Topology is a declarative set of exchanges, queues and bindings. It is used
+// by the subscribers and publishers, and loaded from a YAML or JSON file for
+// the plan/apply/destroy actions.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges" yaml:"exchanges"`
+	Queues    []QueueSpec    `json:"queues" yaml:"queues"`
+	Bindings  []BindingSpec  `json:"bindings" yaml:"bindings"`
+}
+
+// ExchangeRef names an exchange either literally or through util.GetExchangeName
+type ExchangeRef struct {
+	Name    string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Service string            `json:"service,omitempty" yaml:"service,omitempty"`
+	Kind    util.ExchangeType `json:"kind,omitempty" yaml:"kind,omitempty"` // events, commands, retry, dlx, delay, ttl-delay, hash
+}
+
+// ExchangeName resolves the exchange name
+func (r ExchangeRef) ExchangeName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return util.GetExchangeName(r.Service, r.Kind)
+}
+
+// QueueRef names a queue either literally or through util.GetQueueName
+type QueueRef struct {
+	Name    string         `json:"name,omitempty" yaml:"name,omitempty"`
+	Service string         `json:"service,omitempty" yaml:"service,omitempty"`
+	Purpose string         `json:"purpose,omitempty" yaml:"purpose,omitempty"` // defaults to "main"
+	Kind    util.QueueType `json:"kind,omitempty" yaml:"kind,omitempty"`       // normal, retry, dlq, delay
+}
+
+// QueueName resolves the queue name
+func (r QueueRef) QueueName() string {
+	if r.Name != "" || r.Service == "" {
+		return r.Name
+	}
+	purpose := r.Purpose
+	if purpose == "" {
+		purpose = "main"
+	}
+	return util.GetQueueName(r.Service, purpose, r.Kind)
+}
+
+type ExchangeSpec struct {
+	ExchangeRef `yaml:",inline"`
+	Type        string                 `json:"type" yaml:"type"` // direct, topic, fanout, headers, x-consistent-hash
+	Durable     bool                   `json:"durable" yaml:"durable"`
+	AutoDelete  bool                   `json:"auto_delete,omitempty" yaml:"auto_delete,omitempty"`
+	Internal    bool                   `json:"internal,omitempty" yaml:"internal,omitempty"`
+	Arguments   map[string]interface{} `json:"arguments,omitempty" yaml:"arguments,omitempty"`
+}
+
+// DeadLetterSpec sets x-dead-letter-exchange and x-dead-letter-routing-key.
+// Queue is a shorthand for using the target queue's name as the routing key.
+type DeadLetterSpec struct {
+	Exchange   ExchangeRef `json:"exchange" yaml:"exchange"`
+	RoutingKey string      `json:"routing_key,omitempty" yaml:"routing_key,omitempty"`
+	Queue      *QueueRef   `json:"queue,omitempty" yaml:"queue,omitempty"`
+}
+
+type QueueSpec struct {
+	QueueRef   `yaml:",inline"`
+	Type       util.QueueKind  `json:"type,omitempty" yaml:"type,omitempty"` // classic (default), quorum, stream
+	Durable    bool            `json:"durable" yaml:"durable"`
+	AutoDelete bool            `json:"auto_delete,omitempty" yaml:"auto_delete,omitempty"`
+	Exclusive  bool            `json:"exclusive,omitempty" yaml:"exclusive,omitempty"`
+	DeadLetter *DeadLetterSpec `json:"dead_letter,omitempty" yaml:"dead_letter,omitempty"`
+	// QueueLimits bound the queue's length, size and message and queue TTLs
+	QueueLimits `yaml:",inline"`
+	// DeliveryLimit dead-letters a message after it was returned to a quorum
+	// queue this many times (x-delivery-limit), so poison messages cannot
+	// loop forever.
+	DeliveryLimit int `json:"delivery_limit,omitempty" yaml:"delivery_limit,omitempty"`
+	// SingleActiveConsumer delivers to one consumer at a time; the others
+	// wait and take over when it goes away (x-single-active-consumer)
+	SingleActiveConsumer bool                   `json:"single_active_consumer,omitempty" yaml:"single_active_consumer,omitempty"`
+	Arguments            map[string]interface{} `json:"arguments,omitempty" yaml:"arguments,omitempty"`
+}
+
+type BindingSpec struct {
+	Exchange ExchangeRef `json:"exchange" yaml:"exchange"`
+	Queue    QueueRef    `json:"queue" yaml:"queue"`
+	// RoutingKey defaults to the queue name, matching the direct exchange convention
+	RoutingKey string `json:"routing_key,omitempty" yaml:"routing_key,omitempty"`
+	// Headers and Match bind to a headers exchange: messages are routed when
+	// all (default) or any of Headers are present with the same value. They
+	// are sent as the binding arguments, with Match as x-match.
+	Headers   map[string]interface{} `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Match     util.HeadersMatch      `json:"match,omitempty" yaml:"match,omitempty"`
+	Arguments map[string]interface{} `json:"arguments,omitempty" yaml:"arguments,omitempty"`
+}
+
+// LoadTopology reads a topology file. YAML is a superset of JSON, so both
+// formats are parsed by the YAML decoder.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t Topology
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("parse topology %s: %w", path, err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// Validate checks that every reference can be resolved
+func (t *Topology) Validate() (err error) {
+	// util naming helpers panic on empty or unknown input
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	var errs []error
+	for i, e := range t.Exchanges {
+		if e.ExchangeName() == "" {
+			errs = append(errs, fmt.Errorf("exchanges[%d]: name or service is required", i))
+		}
+		switch e.Type {
+		case "direct", "topic", "fanout", "headers", ConsistentHashExchange:
+		default:
+			errs = append(errs, fmt.Errorf("exchanges[%d]: invalid type %q", i, e.Type))
+		}
+	}
+	for i, q := range t.Queues {
+		if q.QueueName() == "" {
+			errs = append(errs, fmt.Errorf("queues[%d]: name or service is required", i))
+		}
+		if q.DeadLetter != nil {
+			q.DeadLetter.Exchange.ExchangeName()
+		}
+		if err := q.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("queues[%d]: %w", i, err))
+		}
+	}
+	types := map[string]string{}
+	for _, e := range t.Exchanges {
+		types[e.ExchangeName()] = e.Type
+	}
+	for i, b := range t.Bindings {
+		if b.Exchange.ExchangeName() == "" || b.Queue.QueueName() == "" {
+			errs = append(errs, fmt.Errorf("bindings[%d]: exchange and queue are required", i))
+		}
+		if err := b.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("bindings[%d]: %w", i, err))
+		}
+		if kind, ok := types[b.Exchange.ExchangeName()]; ok && kind != "headers" && b.isHeaders() {
+			errs = append(errs, fmt.Errorf("bindings[%d]: headers and match require a headers exchange, %s is %s", i, b.Exchange.ExchangeName(), kind))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Args builds the exchange declaration arguments
+func (e ExchangeSpec) Args() amqp.Table {
+	return toTable(e.Arguments)
+}
+
+// Declare declares the exchange
+func (e ExchangeSpec) Declare(ch Channel) error {
+	name := e.ExchangeName()
+	if err := ch.ExchangeDeclare(
+		name,         // name
+		e.Type,       // type
+		e.Durable,    // durable
+		e.AutoDelete, // auto-deleted
+		e.Internal,   // internal
+		false,        // no-wait
+		e.Args(),     // arguments
+	); err != nil {
+		return fmt.Errorf("declare exchange %s: %w", name, err)
+	}
+	return nil
+}
+
+// Validate checks the settings the broker only accepts for some queue types
+func (q QueueSpec) Validate() error {
+	if _, err := util.ParseQueueKind(string(q.Type)); err != nil {
+		return err
+	}
+	if q.DeliveryLimit < 0 {
+		return errors.New("delivery_limit must not be negative")
+	}
+	switch q.Type {
+	case util.QuorumQueue, util.StreamQueue:
+		if !q.Durable || q.AutoDelete || q.Exclusive || q.QueueName() == "" {
+			return fmt.Errorf("%s queues must be named, durable, not exclusive and not auto-delete", q.Type)
+		}
+	}
+	if q.DeliveryLimit > 0 && q.Type != util.QuorumQueue {
+		return errors.New("delivery_limit requires a quorum queue")
+	}
+	if q.SingleActiveConsumer && (q.Type == util.StreamQueue || q.Exclusive) {
+		return errors.New("single_active_consumer requires a classic or quorum queue that is not exclusive")
+	}
+	if q.Type == util.StreamQueue && q.DeadLetter != nil {
+		return errors.New("stream queues do not support dead_letter, use x-max-age retention")
+	}
+	if err := q.QueueLimits.Validate(q.Type); err != nil {
+		return err
+	}
+	if q.Overflow == util.RejectPublishDLX && q.DeadLetter == nil {
+		return errors.New("overflow reject-publish-dlx requires dead_letter")
+	}
+	return nil
+}
+
+// Args builds the queue declaration arguments, including queue type, DLX, TTL and length settings
+func (q QueueSpec) Args() amqp.Table {
+	args := toTable(q.Arguments)
+	if args == nil {
+		args = amqp.Table{}
+	}
+	if q.Type != "" && q.Type != util.ClassicQueue {
+		args["x-queue-type"] = string(q.Type)
+	}
+	if q.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(q.DeliveryLimit)
+	}
+	if q.DeadLetter != nil {
+		args["x-dead-letter-exchange"] = q.DeadLetter.Exchange.ExchangeName()
+		if q.DeadLetter.Queue != nil {
+			args["x-dead-letter-routing-key"] = q.DeadLetter.Queue.QueueName()
+		} else if q.DeadLetter.RoutingKey != "" {
+			args["x-dead-letter-routing-key"] = q.DeadLetter.RoutingKey
+		}
+	}
+	q.QueueLimits.apply(args)
+	if q.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// Declare declares the queue. A spec without a name declares a server-named queue.
+func (q QueueSpec) Declare(ch Channel) (amqp.Queue, error) {
+	name := q.QueueName()
+	if err := q.Validate(); err != nil {
+		return amqp.Queue{}, fmt.Errorf("declare queue %s: %w", name, err)
+	}
+	queue, err := ch.QueueDeclare(
+		name,         // name
+		q.Durable,    // durable
+		q.AutoDelete, // delete when unused
+		q.Exclusive,  // exclusive
+		false,        // no-wait
+		q.Args(),     // arguments
+	)
+	if err != nil {
+		return queue, fmt.Errorf("declare queue %s: %w", name, err)
+	}
+	return queue, nil
+}
+
+// Key resolves the binding routing key
+func (b BindingSpec) Key() string {
+	if b.RoutingKey != "" {
+		return b.RoutingKey
+	}
+	return b.Queue.QueueName()
+}
+
+// isHeaders reports whether the binding matches on headers
+func (b BindingSpec) isHeaders() bool {
+	return len(b.Headers) > 0 || b.Match != ""
+}
+
+// Validate checks the headers exchange settings
+func (b BindingSpec) Validate() error {
+	if _, err := util.ParseHeadersMatch(string(b.Match)); err != nil {
+		return err
+	}
+	for key := range b.Headers {
+		if err := util.ValidateHeaderKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Args builds the binding arguments, including x-match and the headers to
+// match for headers exchange bindings
+func (b BindingSpec) Args() amqp.Table {
+	args := toTable(b.Arguments)
+	if !b.isHeaders() {
+		return args
+	}
+	if args == nil {
+		args = amqp.Table{}
+	}
+	for k, v := range toTable(b.Headers) {
+		args[k] = v
+	}
+	match, _ := util.ParseHeadersMatch(string(b.Match))
+	args["x-match"] = string(match)
+	return args
+}
+
+// Declare binds the queue to the exchange
+func (b BindingSpec) Declare(ch Channel) error {
+	queue, exchange, key := b.Queue.QueueName(), b.Exchange.ExchangeName(), b.Key()
+	if err := b.Validate(); err != nil {
+		return fmt.Errorf("bind %s to %s: %w", queue, exchange, err)
+	}
+	if err := ch.QueueBind(
+		queue,    // queue name
+		key,      // routing key
+		exchange, // exchange
+		false,    // no-wait
+		b.Args(), // arguments
+	); err != nil {
+		return fmt.Errorf("bind %s to %s (%s): %w", queue, exchange, key, err)
+	}
+	return nil
+}
+
+// Apply declares every exchange, then every queue, then every binding
+func (t *Topology) Apply(ch Channel) error {
+	for _, e := range t.Exchanges {
+		if err := e.Declare(ch); err != nil {
+			return err
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := q.Declare(ch); err != nil {
+			return err
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := b.Declare(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Destroy removes the bindings, queues and exchanges in reverse order.
+// Unless force is set, non-empty queues are left in place and reported.
+func (t *Topology) Destroy(ch *amqp.Channel, force bool) error {
+	for _, b := range t.Bindings {
+		queue, exchange, key := b.Queue.QueueName(), b.Exchange.ExchangeName(), b.Key()
+		if err := ch.QueueUnbind(queue, key, exchange, b.Args()); err != nil {
+			return fmt.Errorf("unbind %s from %s (%s): %w", queue, exchange, key, err)
+		}
+	}
+	for _, q := range t.Queues {
+		name := q.QueueName()
+		if _, err := ch.QueueDelete(
+			name,   // name
+			false,  // if-unused
+			!force, // if-empty
+			false,  // no-wait
+		); err != nil {
+			return fmt.Errorf("delete queue %s (use -force to delete non-empty queues): %w", name, err)
+		}
+	}
+	for _, e := range t.Exchanges {
+		name := e.ExchangeName()
+		if err := ch.ExchangeDelete(name, false, false); err != nil {
+			return fmt.Errorf("delete exchange %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// WithQueueType makes every named queue a queue of the given kind. For quorum
+// queues, deliveryLimit is set on the queues that dead-letter somewhere.
+func (t *Topology) WithQueueType(kind util.QueueKind, deliveryLimit int) *Topology {
+	for i := range t.Queues {
+		q := &t.Queues[i]
+		if q.QueueName() == "" {
+			continue // server-named queues are exclusive and stay classic
+		}
+		q.Type = kind
+		if kind == util.QuorumQueue && q.DeadLetter != nil {
+			q.DeliveryLimit = deliveryLimit
+		}
+	}
+	return t
+}
+
+// WithSingleActiveConsumer makes the named queue single active consumer
+func (t *Topology) WithSingleActiveConsumer(queue string) *Topology {
+	for i := range t.Queues {
+		if t.Queues[i].QueueName() == queue {
+			t.Queues[i].SingleActiveConsumer = true
+		}
+	}
+	return t
+}
+
+// WithLimits adds limits to the named queue. Limits already set on the
+// queue, such as the TTL of a retry tier, are only replaced by ones set in
+// limits.
+func (t *Topology) WithLimits(queue string, limits QueueLimits) *Topology {
+	for i := range t.Queues {
+		if t.Queues[i].QueueName() == queue {
+			t.Queues[i].QueueLimits = t.Queues[i].QueueLimits.merge(limits)
+		}
+	}
+	return t
+}
+
+// Merge appends other's declarations to t
+func (t *Topology) Merge(other *Topology) *Topology {
+	t.Exchanges = append(t.Exchanges, other.Exchanges...)
+	t.Queues = append(t.Queues, other.Queues...)
+	t.Bindings = append(t.Bindings, other.Bindings...)
+	return t
+}
+
+// toTable converts decoded YAML/JSON values into AMQP field values
+func toTable(m map[string]interface{}) amqp.Table {
+	if len(m) == 0 {
+		return nil
+	}
+	t := amqp.Table{}
+	for k, v := range m {
+		t[k] = toField(v)
+	}
+	return t
+}
+
+func toField(v interface{}) interface{} {
+	switch fv := v.(type) {
+	case map[string]interface{}:
+		return toTable(fv)
+	case []interface{}:
+		out := make([]interface{}, len(fv))
+		for i, item := range fv {
+			out[i] = toField(item)
+		}
+		return out
+	case int:
+		return int64(fv)
+	case uint64:
+		return int64(fv)
+	case json.Number:
+		if n, err := fv.Int64(); err == nil {
+			return n
+		}
+		f, _ := fv.Float64()
+		return f
+	}
+	return v
+}
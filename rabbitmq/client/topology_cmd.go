@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+type TopologyPayload struct {
+	Conn       *Connection
+	Management *ManagementClient
+	Topology   *Topology
+	Force      bool // destroy non-empty queues
+}
+
+// Change is one difference between the topology spec and the broker
+type Change struct {
+	Action  string // create, update, unmanaged
+	Kind    string // exchange, queue, binding
+	Name    string
+	Details []string
+}
+
+func (c Change) String() string {
+	symbol := map[string]string{"create": "+", "update": "~", "unmanaged": "?"}[c.Action]
+	line := fmt.Sprintf("%s %s %s", symbol, c.Kind, c.Name)
+	for _, d := range c.Details {
+		line += "\n    " + d
+	}
+	return line
+}
+
+// Plan compares the topology with the broker state. Queues and exchanges
+// cannot be redeclared with different settings, so updates need a
+// destroy/apply cycle. Entities on the broker that belong to one of the
+// spec's services but are not in the spec are reported as unmanaged.
+func Plan(t *Topology, state *BrokerState) []Change {
+	var changes []Change
+
+	exchanges := map[string]BrokerExchange{}
+	for _, e := range state.Exchanges {
+		exchanges[e.Name] = e
+	}
+	queues := map[string]BrokerQueue{}
+	for _, q := range state.Queues {
+		queues[q.Name] = q
+	}
+	// A queue can be bound with the same key several times when the
+	// arguments differ, e.g. headers exchange bindings
+	bindings := map[string][]BrokerBinding{}
+	for _, b := range state.Bindings {
+		if b.DestinationType == "queue" {
+			id := bindingID(b.Source, b.Destination, b.RoutingKey)
+			bindings[id] = append(bindings[id], b)
+		}
+	}
+
+	managed := map[string]bool{}
+	for _, e := range t.Exchanges {
+		name := e.ExchangeName()
+		managed[name] = true
+		actual, ok := exchanges[name]
+		if !ok {
+			changes = append(changes, Change{Action: "create", Kind: "exchange", Name: name, Details: []string{"type: " + e.Type}})
+			continue
+		}
+		var details []string
+		details = appendDiff(details, "type", actual.Type, e.Type)
+		details = appendDiff(details, "durable", actual.Durable, e.Durable)
+		details = appendDiff(details, "auto_delete", actual.AutoDelete, e.AutoDelete)
+		details = appendDiff(details, "internal", actual.Internal, e.Internal)
+		details = append(details, diffArgs(actual.Arguments, e.Args())...)
+		if len(details) > 0 {
+			changes = append(changes, Change{Action: "update", Kind: "exchange", Name: name, Details: details})
+		}
+	}
+
+	for _, q := range t.Queues {
+		name := q.QueueName()
+		if name == "" {
+			continue // server-named queues only exist per connection
+		}
+		managed[name] = true
+		actual, ok := queues[name]
+		if !ok {
+			changes = append(changes, Change{Action: "create", Kind: "queue", Name: name})
+			continue
+		}
+		var details []string
+		wantType := string(q.Type)
+		if wantType == "" {
+			wantType = string(util.ClassicQueue)
+		}
+		if actual.Type != "" {
+			details = appendDiff(details, "type", actual.Type, wantType)
+		}
+		details = appendDiff(details, "durable", actual.Durable, q.Durable)
+		details = appendDiff(details, "auto_delete", actual.AutoDelete, q.AutoDelete)
+		details = appendDiff(details, "exclusive", actual.Exclusive, q.Exclusive)
+		details = append(details, diffArgs(withoutQueueType(actual.Arguments), withoutQueueType(q.Args()))...)
+		if len(details) > 0 {
+			details = append(details, fmt.Sprintf("requires destroy/apply (%d messages in queue)", actual.Messages))
+			changes = append(changes, Change{Action: "update", Kind: "queue", Name: name, Details: details})
+		}
+	}
+
+	for _, b := range t.Bindings {
+		source, dest, key := b.Exchange.ExchangeName(), b.Queue.QueueName(), b.Key()
+		name := fmt.Sprintf("%s -> %s (%s)", source, dest, key)
+		candidates := bindings[bindingID(source, dest, key)]
+		var details []string
+		for i, actual := range candidates {
+			diff := diffArgs(actual.Arguments, b.Args())
+			if len(diff) == 0 {
+				details = nil
+				break
+			}
+			if i == 0 {
+				details = diff
+			}
+		}
+		switch {
+		case len(candidates) == 0:
+			changes = append(changes, Change{Action: "create", Kind: "binding", Name: name})
+		case len(details) > 0 && b.isHeaders():
+			// Bindings with other headers are separate bindings, not this one
+			changes = append(changes, Change{Action: "create", Kind: "binding", Name: name, Details: bindingHeaders(b.Args())})
+		case len(details) > 0:
+			changes = append(changes, Change{Action: "update", Kind: "binding", Name: name, Details: details})
+		}
+	}
+
+	services := t.services()
+	for _, e := range state.Exchanges {
+		if !managed[e.Name] && belongsTo(e.Name, services) {
+			changes = append(changes, Change{Action: "unmanaged", Kind: "exchange", Name: e.Name})
+		}
+	}
+	for _, q := range state.Queues {
+		if !managed[q.Name] && belongsTo(q.Name, services) {
+			changes = append(changes, Change{Action: "unmanaged", Kind: "queue", Name: q.Name})
+		}
+	}
+
+	return changes
+}
+
+// services lists the service names the spec expands through util naming
+func (t *Topology) services() []string {
+	seen := map[string]bool{}
+	for _, e := range t.Exchanges {
+		if e.Service != "" {
+			seen[e.Service] = true
+		}
+	}
+	for _, q := range t.Queues {
+		if q.Service != "" {
+			seen[q.Service] = true
+		}
+	}
+	var out []string
+	for s := range seen {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// belongsTo matches util naming: <prefix>.<service>.x and q.<service>.<purpose>
+func belongsTo(name string, services []string) bool {
+	for _, s := range services {
+		if strings.HasSuffix(name, "."+s+".x") || strings.HasPrefix(name, "q."+s+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// bindingHeaders describes the arguments of a headers exchange binding
+func bindingHeaders(args amqp.Table) []string {
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	details := make([]string, len(keys))
+	for i, k := range keys {
+		details[i] = fmt.Sprintf("%s: %v", k, args[k])
+	}
+	return details
+}
+
+func bindingID(source, dest, key string) string {
+	return source + "\x00" + dest + "\x00" + key
+}
+
+func appendDiff(details []string, field string, actual, want interface{}) []string {
+	if actual != want {
+		details = append(details, fmt.Sprintf("%s: %v -> %v", field, actual, want))
+	}
+	return details
+}
+
+func withoutQueueType(args map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range args {
+		if k != "x-queue-type" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// diffArgs compares arguments, treating all numbers as float64 because the
+// management API returns JSON numbers.
+func diffArgs(actual, want map[string]interface{}) []string {
+	keys := map[string]bool{}
+	for k := range actual {
+		keys[k] = true
+	}
+	for k := range want {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var details []string
+	for _, k := range sorted {
+		a, aok := actual[k]
+		w, wok := want[k]
+		switch {
+		case !aok:
+			details = append(details, fmt.Sprintf("arguments.%s: <unset> -> %v", k, w))
+		case !wok:
+			details = append(details, fmt.Sprintf("arguments.%s: %v -> <unset>", k, a))
+		case !reflect.DeepEqual(normalizeArg(a), normalizeArg(w)):
+			details = append(details, fmt.Sprintf("arguments.%s: %v -> %v", k, a, w))
+		}
+	}
+	return details
+}
+
+func normalizeArg(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case amqp.Table:
+		return normalizeArg(map[string]interface{}(n))
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, item := range n {
+			out[k] = normalizeArg(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(n))
+		for i, item := range n {
+			out[i] = normalizeArg(item)
+		}
+		return out
+	}
+	return v
+}
+
+// TopologyPlan prints the changes apply would make
+func TopologyPlan(payload *TopologyPayload) error {
+	state, err := payload.Management.State(context.Background())
+	if err != nil {
+		return err
+	}
+	changes := Plan(payload.Topology, state)
+	if len(changes) == 0 {
+		fmt.Println("No changes. The broker matches the topology.")
+		return nil
+	}
+	counts := map[string]int{}
+	for _, c := range changes {
+		fmt.Println(c)
+		counts[c.Action]++
+	}
+	fmt.Printf("\nPlan: %d to create, %d to update, %d unmanaged\n", counts["create"], counts["update"], counts["unmanaged"])
+	return nil
+}
+
+// TopologyApply declares every entity in the topology
+func TopologyApply(payload *TopologyPayload) error {
+	ch, err := payload.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := payload.Topology.Apply(ch); err != nil {
+		return fmt.Errorf("%w (run -action plan to see what differs)", err)
+	}
+	fmt.Printf("Applied %d exchanges, %d queues, %d bindings\n",
+		len(payload.Topology.Exchanges), len(payload.Topology.Queues), len(payload.Topology.Bindings))
+	return nil
+}
+
+// TopologyDestroy deletes every entity in the topology
+func TopologyDestroy(payload *TopologyPayload) error {
+	ch, err := payload.Conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := payload.Topology.Destroy(ch, payload.Force); err != nil {
+		return err
+	}
+	fmt.Printf("Destroyed %d exchanges, %d queues, %d bindings\n",
+		len(payload.Topology.Exchanges), len(payload.Topology.Queues), len(payload.Topology.Bindings))
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/ribbinpo/scripts-template/rabbitmq/client/util"
+)
+
+func TestBindingSpecHeaders(t *testing.T) {
+	exchange := ExchangeRef{Service: "orders", Kind: util.Events}
+	queue := QueueRef{Service: "orders", Purpose: "acme", Kind: util.NormalQueue}
+
+	binding := BindingSpec{Exchange: exchange, Queue: queue, Headers: map[string]interface{}{"tenant": "acme", "priority": 1}}
+	want := amqp.Table{"tenant": "acme", "priority": int64(1), "x-match": "all"}
+	if got := binding.Args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Args() = %v, want %v", got, want)
+	}
+	binding.Match = util.MatchAny
+	if got := binding.Args()["x-match"]; got != "any" {
+		t.Errorf("x-match = %v, want any", got)
+	}
+	if args := (BindingSpec{Exchange: exchange, Queue: queue}).Args(); args != nil {
+		t.Errorf("Args() of a plain binding = %v, want nil", args)
+	}
+
+	tests := []struct {
+		name    string
+		kind    string
+		binding BindingSpec
+		wantErr string
+	}{
+		{"valid", "headers", binding, ""},
+		{"invalid match", "headers", BindingSpec{Exchange: exchange, Queue: queue, Match: "some"}, "invalid x-match"},
+		{"x- header", "headers", BindingSpec{Exchange: exchange, Queue: queue, Headers: map[string]interface{}{"x-tenant": "acme"}}, "x-tenant"},
+		{"not a headers exchange", "direct", binding, "require a headers exchange"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := &Topology{
+				Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: tt.kind, Durable: true}},
+				Queues:    []QueueSpec{{QueueRef: queue, Durable: true}},
+				Bindings:  []BindingSpec{tt.binding},
+			}
+			err := topology.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanHeadersBindings(t *testing.T) {
+	exchange := ExchangeRef{Service: "orders", Kind: util.Events}
+	queue := QueueRef{Service: "orders", Kind: util.NormalQueue}
+	acme := BindingSpec{Exchange: exchange, Queue: queue, Headers: map[string]interface{}{"tenant": "acme"}}
+	globex := BindingSpec{Exchange: exchange, Queue: queue, Headers: map[string]interface{}{"tenant": "globex"}}
+	topology := &Topology{
+		Exchanges: []ExchangeSpec{{ExchangeRef: exchange, Type: "headers", Durable: true}},
+		Queues:    []QueueSpec{{QueueRef: queue, Durable: true}},
+		Bindings:  []BindingSpec{acme, globex},
+	}
+	state := &BrokerState{
+		Exchanges: []BrokerExchange{{Name: "events.orders.x", Type: "headers", Durable: true}},
+		Queues:    []BrokerQueue{{Name: "q.orders.main", Durable: true, Arguments: map[string]interface{}{}}},
+		Bindings: []BrokerBinding{{
+			Source:          "events.orders.x",
+			Destination:     "q.orders.main",
+			DestinationType: "queue",
+			RoutingKey:      "q.orders.main",
+			Arguments:       map[string]interface{}{"tenant": "globex", "x-match": "all"},
+		}},
+	}
+
+	changes := Plan(topology, state)
+	if len(changes) != 1 || changes[0].Action != "create" || changes[0].Kind != "binding" {
+		t.Fatalf("Plan() = %v, want the acme binding to be created", changes)
+	}
+	if details := strings.Join(changes[0].Details, ", "); details != "tenant: acme, x-match: all" {
+		t.Errorf("details = %q", details)
+	}
+}
+
+func TestQueueSpecSingleActiveConsumer(t *testing.T) {
+	queue := QueueSpec{QueueRef: QueueRef{Service: "orders", Kind: util.NormalQueue}, Durable: true, SingleActiveConsumer: true}
+	if got := queue.Args()["x-single-active-consumer"]; got != true {
+		t.Errorf("x-single-active-consumer = %v, want true", got)
+	}
+	quorum := queue
+	quorum.Type = util.QuorumQueue
+	if err := quorum.Validate(); err != nil {
+		t.Errorf("Validate() of a quorum queue = %v", err)
+	}
+	stream := queue
+	stream.Type = util.StreamQueue
+	if err := stream.Validate(); err == nil {
+		t.Error("Validate() of a single active consumer stream succeeded")
+	}
+	exclusive := QueueSpec{Exclusive: true, AutoDelete: true, SingleActiveConsumer: true}
+	if err := exclusive.Validate(); err == nil {
+		t.Error("Validate() of a single active consumer exclusive queue succeeded")
+	}
+}
+
+func TestPartitionedTopology(t *testing.T) {
+	topology := PartitionedTopology("orders", "main", 3)
+	if err := topology.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var partitions []string
+	for _, q := range topology.Queues {
+		if q.Kind == util.DLQ {
+			continue
+		}
+		partitions = append(partitions, q.QueueName())
+		if !q.SingleActiveConsumer || q.DeadLetter == nil || q.DeadLetter.Queue.QueueName() != "q.orders.main.dlq" {
+			t.Errorf("%s: single active consumer %t, dead letter %+v", q.QueueName(), q.SingleActiveConsumer, q.DeadLetter)
+		}
+	}
+	if want := []string{"q.orders.main.p0", "q.orders.main.p1", "q.orders.main.p2"}; !reflect.DeepEqual(partitions, want) {
+		t.Errorf("partitions = %v, want %v", partitions, want)
+	}
+	for _, b := range topology.Bindings {
+		if b.Exchange.ExchangeName() == "hash.orders.x" && b.Key() != "1" {
+			t.Errorf("%s is bound with weight %q, want 1", b.Queue.QueueName(), b.Key())
+		}
+	}
+
+	// The consistent-hash exchange does not clash with events.orders.x
+	b := newFakeBroker()
+	if err := DirectTopology("orders").Apply(b.Channel()); err != nil {
+		t.Fatal(err)
+	}
+	if err := PartitionedTopology("orders", "audit", 3).Apply(b.Channel()); err != nil {
+		t.Errorf("partitioning a topic with a direct exchange: %v", err)
+	}
+}
+
+func TestParsePartitionIDs(t *testing.T) {
+	got, err := ParsePartitionIDs("0, 2,5")
+	if err != nil || !reflect.DeepEqual(got, []int{0, 2, 5}) {
+		t.Errorf("ParsePartitionIDs() = %v, %v", got, err)
+	}
+	if got, err := ParsePartitionIDs(""); got != nil || err != nil {
+		t.Errorf("ParsePartitionIDs(\"\") = %v, %v, want all partitions", got, err)
+	}
+	for _, s := range []string{"1,1", "-1", "a", "1,,2"} {
+		if _, err := ParsePartitionIDs(s); err == nil {
+			t.Errorf("ParsePartitionIDs(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestParseQueueLimits(t *testing.T) {
+	got, err := ParseQueueLimits("max-length=10000, max-length-bytes=512mb,overflow=reject-publish,message-ttl=24h,expires=1h")
+	want := QueueLimits{MaxLength: 10000, MaxLengthBytes: 512 << 20, Overflow: util.RejectPublish, MessageTTL: 86400000, Expires: 3600000}
+	if err != nil || got != want {
+		t.Errorf("ParseQueueLimits() = %+v, %v, want %+v", got, err, want)
+	}
+	for _, s := range []string{"max-length", "max-length=-1", "max-length-bytes=1tb", "overflow=drop-tail", "message-ttl=1us", "priority=1"} {
+		if _, err := ParseQueueLimits(s); err == nil {
+			t.Errorf("ParseQueueLimits(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestQueueSpecLimits(t *testing.T) {
+	dlq := QueueRef{Service: "orders", Kind: util.DLQ}
+	queue := QueueSpec{
+		QueueRef:    QueueRef{Service: "orders", Kind: util.NormalQueue},
+		Durable:     true,
+		QueueLimits: QueueLimits{MaxLength: 100, Overflow: util.RejectPublishDLX, MessageTTL: 1000, Expires: 60000},
+		DeadLetter:  &DeadLetterSpec{Exchange: ExchangeRef{Service: "orders", Kind: util.DLX}, Queue: &dlq},
+	}
+	args := queue.Args()
+	for key, want := range map[string]interface{}{"x-max-length": int64(100), "x-overflow": "reject-publish-dlx", "x-message-ttl": int64(1000), "x-expires": int64(60000)} {
+		if args[key] != want {
+			t.Errorf("%s = %v, want %v", key, args[key], want)
+		}
+	}
+	if err := queue.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(q *QueueSpec)
+	}{
+		{"reject-publish-dlx without a DLX", func(q *QueueSpec) { q.DeadLetter = nil }},
+		{"reject-publish-dlx on a quorum queue", func(q *QueueSpec) { q.Type = util.QuorumQueue }},
+		{"overflow without a max length", func(q *QueueSpec) { q.MaxLength = 0 }},
+		{"max length on a stream", func(q *QueueSpec) {
+			q.Type, q.DeadLetter, q.QueueLimits = util.StreamQueue, nil, QueueLimits{MaxLength: 100}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := queue
+			tt.modify(&q)
+			if err := q.Validate(); err == nil {
+				t.Error("Validate() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("rabbitmq-client")
+
+// InitTracer sets the W3C trace context and baggage propagators, so trace
+// context is passed through messages even when spans are not exported. When
+// endpoint is set, e.g. http://alloy:4318, spans are exported there over
+// OTLP/HTTP. The returned function flushes and stops the exporter.
+func InitTracer(ctx context.Context, serviceName, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("otlp trace exporter: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// headerCarrier adapts AMQP headers to the propagation.TextMapCarrier interface
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// injectTrace writes traceparent and baggage for ctx into headers, which may
+// be nil, and returns them. Existing trace headers are replaced, so a
+// forwarded message continues the current trace.
+func injectTrace(ctx context.Context, headers amqp.Table) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		out[k] = v
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(out))
+	return out
+}
+
+// exchangeName is the destination name of a publish or delivery
+func exchangeName(exchange string) string {
+	if exchange == "" {
+		return "amq.default"
+	}
+	return exchange
+}
+
+// startPublishSpan starts a producer span for msg and injects its context
+// into msg.Headers
+func startPublishSpan(ctx context.Context, exchange, routingKey string, msg *amqp.Publishing) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "publish "+exchangeName(exchange),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeSend,
+			semconv.MessagingDestinationName(exchangeName(exchange)),
+			semconv.MessagingRabbitmqDestinationRoutingKey(routingKey),
+			semconv.MessagingMessageID(msg.MessageId),
+			semconv.MessagingMessageBodySize(len(msg.Body)),
+		),
+	)
+	msg.Headers = injectTrace(ctx, msg.Headers)
+	return ctx, span
+}
+
+// startConsumeSpan starts a consumer span for d, as a child of the trace
+// context in its headers
+func startConsumeSpan(ctx context.Context, d amqp.Delivery) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(d.Headers))
+	return tracer.Start(ctx, "process "+exchangeName(d.Exchange),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingDestinationName(exchangeName(d.Exchange)),
+			semconv.MessagingRabbitmqDestinationRoutingKey(d.RoutingKey),
+			semconv.MessagingRabbitmqMessageDeliveryTag(int(d.DeliveryTag)),
+			semconv.MessagingMessageID(d.MessageId),
+			semconv.MessagingMessageConversationID(d.CorrelationId),
+			semconv.MessagingMessageBodySize(len(d.Body)),
+			attribute.Bool("messaging.rabbitmq.redelivered", d.Redelivered),
+		),
+	)
+}
+
+// tracedDelivery runs fn inside a consumer span for each delivery
+func tracedDelivery(fn DeliveryFunc) DeliveryFunc {
+	return func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+		ctx, span := startConsumeSpan(ctx, d)
+		defer span.End()
+		fn(ctx, ch, d)
+	}
+}
+
+// spanError records a failed handler or publish on the current span
+func spanError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// spanEvent adds an event such as a retry or a DLQ move to the current span
+func spanEvent(ctx context.Context, name string, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).AddEvent(name, trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Maximum routing key length allowed by AMQP 0-9-1 (shortstr)
+const maxRoutingKeyLength = 255
+
+// ValidateBindingKey checks a topic exchange binding pattern. Words are
+// separated by dots, and the wildcards must be whole words:
+// "*" matches exactly one word and "#" matches zero or more words.
+func ValidateBindingKey(pattern string) error {
+	if len(pattern) > maxRoutingKeyLength {
+		return fmt.Errorf("binding key %q is longer than %d bytes", pattern, maxRoutingKeyLength)
+	}
+	for _, word := range strings.Split(pattern, ".") {
+		if word == "*" || word == "#" {
+			continue
+		}
+		if strings.ContainsAny(word, "*#") {
+			return fmt.Errorf("binding key %q: wildcard in %q must be a whole word", pattern, word)
+		}
+	}
+	return nil
+}
+
+// ValidateRoutingKey checks a key used to publish. Publishing with a
+// wildcard is allowed by the broker but never matches what was intended.
+func ValidateRoutingKey(key string) error {
+	if len(key) > maxRoutingKeyLength {
+		return fmt.Errorf("routing key %q is longer than %d bytes", key, maxRoutingKeyLength)
+	}
+	if strings.ContainsAny(key, "*#") {
+		return fmt.Errorf("routing key %q must not contain wildcards", key)
+	}
+	return nil
+}
+
+// HeadersMatch is the x-match argument of a headers exchange binding
+type HeadersMatch string
+
+const (
+	MatchAll HeadersMatch = "all" // every bound header must be present and equal
+	MatchAny HeadersMatch = "any" // at least one bound header must be present and equal
+)
+
+// ParseHeadersMatch accepts all or any; empty means all
+func ParseHeadersMatch(s string) (HeadersMatch, error) {
+	switch match := HeadersMatch(s); match {
+	case "":
+		return MatchAll, nil
+	case MatchAll, MatchAny:
+		return match, nil
+	}
+	return "", fmt.Errorf("invalid x-match %q, must be all or any", s)
+}
+
+// ValidateHeaderKey checks a header a headers exchange binding matches on.
+// The broker ignores headers starting with "x-" for all and any matching.
+func ValidateHeaderKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("header name must not be empty")
+	}
+	if strings.HasPrefix(key, "x-") {
+		return fmt.Errorf("header %q: headers starting with x- are not matched by headers exchanges", key)
+	}
+	return nil
+}
@@ -1,5 +1,11 @@
 package util
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type ExchangeType string
 
 const (
@@ -7,6 +13,9 @@ const (
 	Commands ExchangeType = "commands"
 	Retry    ExchangeType = "retry"
 	DLX      ExchangeType = "dlx"
+	Delay    ExchangeType = "delay"     // x-delayed-message exchange of the delay plugin
+	TTLDelay ExchangeType = "ttl-delay" // headers exchange of the TTL delay buckets
+	Hash     ExchangeType = "hash"      // consistent-hash exchange of partitioned topics
 )
 
 type QueueType string
@@ -15,29 +24,93 @@ const (
 	NormalQueue QueueType = "normal"
 	RetryQueue  QueueType = "retry"
 	DLQ         QueueType = "dlq"
+	DelayQueue  QueueType = "delay"
+)
+
+// QueueKind is the x-queue-type of a queue. Classic queues are not replicated,
+// so clustered deployments should use quorum queues or streams.
+type QueueKind string
+
+const (
+	ClassicQueue QueueKind = "classic"
+	QuorumQueue  QueueKind = "quorum"
+	StreamQueue  QueueKind = "stream"
+)
+
+// ParseQueueKind accepts classic, quorum or stream; empty means classic
+func ParseQueueKind(s string) (QueueKind, error) {
+	switch kind := QueueKind(s); kind {
+	case "":
+		return ClassicQueue, nil
+	case ClassicQueue, QuorumQueue, StreamQueue:
+		return kind, nil
+	}
+	return "", fmt.Errorf("invalid queue type %q, must be classic, quorum or stream", s)
+}
+
+// Overflow is the x-overflow behaviour of a queue that reached its
+// x-max-length or x-max-length-bytes
+type Overflow string
+
+const (
+	DropHead         Overflow = "drop-head"          // drop or dead-letter the oldest messages
+	RejectPublish    Overflow = "reject-publish"     // nack new messages
+	RejectPublishDLX Overflow = "reject-publish-dlx" // nack and dead-letter new messages, classic queues only
 )
 
+// ParseOverflow accepts drop-head, reject-publish or reject-publish-dlx;
+// empty means drop-head
+func ParseOverflow(s string) (Overflow, error) {
+	switch overflow := Overflow(s); overflow {
+	case "":
+		return DropHead, nil
+	case DropHead, RejectPublish, RejectPublishDLX:
+		return overflow, nil
+	}
+	return "", fmt.Errorf("invalid overflow %q, must be drop-head, reject-publish or reject-publish-dlx", s)
+}
+
+// exchangePrefixes are the first word of the exchange names of each type
+var exchangePrefixes = map[ExchangeType]string{
+	Events:   "events",
+	Commands: "cmd",
+	Retry:    "retry",
+	DLX:      "dlx",
+	Delay:    "delay",
+	TTLDelay: "ttl-delay",
+	Hash:     "hash",
+}
+
 func GetExchangeName(service string, exchangeType ExchangeType) string {
 	if service == "" {
 		panic("service is required")
 	}
-	var prefix string
-	switch exchangeType {
-	case Events:
-		prefix = "events"
-	case Commands:
-		prefix = "cmd"
-	case Retry:
-		prefix = "retry"
-	case DLX:
-		prefix = "dlx"
-	default:
+	prefix, ok := exchangePrefixes[exchangeType]
+	if !ok {
 		panic("invalid exchange type")
 	}
 	return prefix + "." + service + ".x"
 }
 
-func GetQueueName(service string, purpose string, queueType QueueType) string {
+// ParseExchangeName returns the service and type of a name built by
+// GetExchangeName, e.g. orders and Events for events.orders.x
+func ParseExchangeName(name string) (string, ExchangeType, bool) {
+	prefix, rest, _ := strings.Cut(name, ".")
+	service, ok := strings.CutSuffix(rest, ".x")
+	if !ok || service == "" {
+		return "", "", false
+	}
+	for exchangeType, p := range exchangePrefixes {
+		if p == prefix {
+			return service, exchangeType, true
+		}
+	}
+	return "", "", false
+}
+
+// GetQueueName builds q.<service>.<purpose>[.retry|.dlq|.delay], followed by
+// any qualifiers, e.g. the delay of a retry tier: q.orders.main.retry.4s
+func GetQueueName(service string, purpose string, queueType QueueType, qualifiers ...string) string {
 	if service == "" {
 		panic("service is required")
 	}
@@ -50,8 +123,33 @@ func GetQueueName(service string, purpose string, queueType QueueType) string {
 		suffix = ".retry"
 	case DLQ:
 		suffix = ".dlq"
+	case DelayQueue:
+		suffix = ".delay"
 	default:
 		suffix = ""
 	}
-	return "q." + service + "." + purpose + suffix
+	name := "q." + service + "." + purpose + suffix
+	for _, q := range qualifiers {
+		if q == "" {
+			panic("qualifier must not be empty")
+		}
+		name += "." + q
+	}
+	return name
+}
+
+// FormatDelay renders a delay for use in queue names, in the largest whole
+// unit: 500ms, 4s, 5m, 2h
+func FormatDelay(d time.Duration) string {
+	switch {
+	case d <= 0:
+		panic("delay must be positive")
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// How often per-worker throughput is logged
+const workerReportInterval = 10 * time.Second
+
+// workerStats counts the deliveries handled by one worker
+type workerStats struct {
+	tag      string
+	handled  atomic.Int64
+	busy     atomic.Int64 // nanoseconds spent in the handler
+	reported int64        // handled count at the previous report
+}
+
+// runWorkers starts payload.Workers consumers on the queue returned by setup.
+// Each worker has its own channel, Qos and consumer tag (<tag>-1 ... <tag>-N),
+// so a slow handler only holds up its own prefetched messages.
+func runWorkers(ctx context.Context, payload *SubscriberPayload, tag string, setup func(ch Channel) (string, error), fn DeliveryFunc) error {
+	workers := payload.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	consumers := make([]consumerSpec, workers)
+	for i := range consumers {
+		consumers[i] = consumerSpec{tag: fmt.Sprintf("%s-%d", tag, i+1), setup: setup}
+	}
+	return runConsumers(ctx, payload, consumers, fn)
+}
+
+// consumerSpec is one consumer started by runConsumers
+type consumerSpec struct {
+	tag   string
+	setup func(ch Channel) (string, error)
+}
+
+// runConsumers starts one consumer per spec, each on its own channel and on
+// the queue returned by its setup. Acks stay manual and are done by fn, which
+// runs inside a consumer span and is counted in the consumed/acked/nacked
+// metrics. Throughput is logged per consumer every workerReportInterval and
+// once more on shutdown.
+func runConsumers(ctx context.Context, payload *SubscriberPayload, consumers []consumerSpec, fn DeliveryFunc) error {
+	stats := make([]*workerStats, len(consumers))
+	for i, c := range consumers {
+		stats[i] = &workerStats{tag: c.tag}
+	}
+
+	reportCtx, stopReport := context.WithCancel(ctx)
+	defer stopReport()
+	go func() {
+		ticker := time.NewTicker(workerReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reportWorkers(stats, workerReportInterval)
+			case <-reportCtx.Done():
+				return
+			}
+		}
+	}()
+
+	log.Printf("Starting %d worker(s) with prefetch %d", len(consumers), payload.Prefetch)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(consumers))
+	for i, c := range consumers {
+		// The queue name is only known once setup has run, e.g. for server-named queues
+		var queue atomic.Value
+		queue.Store("")
+		meteredSetup := func(ch Channel) (string, error) {
+			name, err := c.setup(ch)
+			queue.Store(name)
+			return name, err
+		}
+		metered := meteredDelivery(payload.Topic, func() string { return queue.Load().(string) }, fn)
+
+		wg.Add(1)
+		go func(s *workerStats) {
+			defer wg.Done()
+			err := payload.Conn.Consume(ctx, ConsumeOptions{
+				Tag:             s.tag,
+				Prefetch:        payload.Prefetch,
+				ShutdownTimeout: payload.ShutdownTimeout,
+				Setup:           meteredSetup,
+				Breaker:         payload.Breaker,
+				SingleActive:    payload.SingleActive,
+			}, tracedDelivery(func(ctx context.Context, ch ConfirmPublisher, d amqp.Delivery) {
+				start := time.Now()
+				metered(ctx, ch, d)
+				s.busy.Add(int64(time.Since(start)))
+				s.handled.Add(1)
+			}))
+			if err != nil {
+				errs <- fmt.Errorf("worker %s: %w", s.tag, err)
+			}
+		}(stats[i])
+	}
+	wg.Wait()
+	close(errs)
+
+	stopReport()
+	for _, s := range stats {
+		log.Printf("Worker %s handled %d messages in total", s.tag, s.handled.Load())
+	}
+
+	return <-errs
+}
+
+// reportWorkers logs each worker's rate since the previous report
+func reportWorkers(stats []*workerStats, interval time.Duration) {
+	var total int64
+	for _, s := range stats {
+		handled := s.handled.Load()
+		delta := handled - s.reported
+		s.reported = handled
+		total += delta
+
+		avg := time.Duration(0)
+		if handled > 0 {
+			avg = time.Duration(s.busy.Load() / handled)
+		}
+		log.Printf("Worker %s: %.1f msg/s (%d total, avg handler time %s)",
+			s.tag, float64(delta)/interval.Seconds(), handled, avg.Round(time.Microsecond))
+	}
+	if len(stats) > 1 {
+		log.Printf("All workers: %.1f msg/s", float64(total)/interval.Seconds())
+	}
+}